@@ -0,0 +1,152 @@
+// SPDX-FileCopyrightText: 2022 Marshall Wace <opensource@mwam.com>
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+var adminTokenFlag string
+
+type peersRequest struct {
+	Peers []string `json:"peers"`
+}
+
+// adminMiddleware guards the admin API. With JWT auth enabled, jwtMiddleware has already
+// required an ADMIN action, otherwise the -admin-token bearer token is required
+func adminMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if jwtRsaPubKeyFlag != "" {
+			return
+		}
+		requireAdminToken(c)
+	}
+}
+
+// peerAdminMiddleware guards peer routes changing the cluster, which without peer auth are
+// admin requests like the /admin API, propagated with the admin's credentials
+func peerAdminMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if peerAuthEnabled() || jwtRsaPubKeyFlag != "" {
+			return
+		}
+		requireAdminToken(c)
+	}
+}
+
+// isAdminRequest reports whether a request needs an ADMIN action JWT
+func isAdminRequest(path string) bool {
+	return strings.HasPrefix(path, "/admin/") || (path == "/_groupcache/peers" && !peerAuthEnabled())
+}
+
+// requireAdminToken aborts requests without the -admin-token bearer token
+func requireAdminToken(c *gin.Context) {
+	if adminTokenFlag == "" {
+		c.JSON(403, gin.H{"error": "Admin API is disabled, enable JWT auth or set -admin-token"})
+		c.Abort()
+		return
+	}
+
+	token := strings.TrimSpace(strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer"))
+	if subtle.ConstantTimeCompare([]byte(token), []byte(adminTokenFlag)) != 1 {
+		log.Debugf("Admin request without a valid admin token, returning 401")
+		c.JSON(401, gin.H{"error": "Missing or invalid admin token"})
+		c.Abort()
+	}
+}
+
+// restAdminGetPeers shows the cluster members, which were set statically (-peers or
+// PUT /admin/peers) rather than discovered, and which have an open circuit
+func restAdminGetPeers(c *gin.Context) {
+	members, static := currentPeers()
+	c.JSON(200, gin.H{"self": selfPeer, "peers": members, "static": static, "unhealthy": unhealthyPeers()})
+}
+
+// restAdminSetPeers replaces the static peers, on every node of the new set with propagate=true
+func restAdminSetPeers(c *gin.Context) {
+	req := peersRequest{}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("Invalid peers: %v", err)})
+		return
+	}
+	newPeers, err := validatePeers(req.Peers)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	log.Infof("Setting peers through the admin API: %s", strings.Join(newPeers, ", "))
+	setStaticPeers(newPeers)
+	members, _ := currentPeers()
+	if c.Query("propagate") != "true" {
+		c.JSON(200, gin.H{"message": "Peers updated", "peers": members, "error": ""})
+		return
+	}
+
+	// The new set as seen from other nodes includes this one
+	propagated := peersRequest{Peers: append([]string{selfPeer}, newPeers...)}
+	// Without peer auth, other nodes check the same admin token or JWT this request had
+	authorization := ""
+	if !peerAuthEnabled() {
+		authorization = c.GetHeader("Authorization")
+	}
+	ctx, cancel := context.WithTimeout(c.Request.Context(), time.Millisecond*time.Duration(timeout))
+	defer cancel()
+	errs := fanOut(func(peerURL string) error {
+		return peerJSONAuthorized(ctx, http.MethodPut, peerURL+"peers", authorization, propagated, nil)
+	})
+	if len(errs) > 0 {
+		msg := fmt.Sprintf("Failed to propagate peers to peer(s): %s", fanOutError(errs))
+		log.Errorf(msg)
+		c.JSON(500, gin.H{"error": msg, "peers": members})
+		return
+	}
+	c.JSON(200, gin.H{"message": "Peers updated on all nodes", "peers": members, "error": ""})
+}
+
+// serveSetPeers replaces the static peers for a node propagating an admin change
+func serveSetPeers(c *gin.Context) {
+	req := peersRequest{}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("Invalid peers: %v", err)})
+		return
+	}
+	newPeers, err := validatePeers(req.Peers)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	log.Infof("Setting peers propagated by another node: %s", strings.Join(newPeers, ", "))
+	setStaticPeers(newPeers)
+	c.JSON(200, gin.H{"message": "Peers updated"})
+}
+
+// validatePeers normalises peers like -peers, rejecting empty ones and ones that aren't valid URLs
+func validatePeers(newPeers []string) ([]string, error) {
+	trimmed := []string{}
+	for _, peer := range newPeers {
+		peer = strings.TrimSuffix(strings.TrimSpace(peer), "/")
+		if peer == "" {
+			return nil, fmt.Errorf("empty peer, expected e.g. 'http://peer1:8080'")
+		}
+		trimmed = append(trimmed, peer)
+	}
+	cleaned := cleanupPeers(trimmed)
+	for _, peer := range cleaned {
+		u, err := url.Parse(peer)
+		if err != nil || u.Hostname() == "" || u.Path != "" {
+			return nil, fmt.Errorf("invalid peer '%s', expected e.g. 'http://peer1:8080'", peer)
+		}
+	}
+	return cleaned, nil
+}
@@ -0,0 +1,250 @@
+// SPDX-FileCopyrightText: 2022 Marshall Wace <opensource@mwam.com>
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/adrianchifor/go-parallel"
+	"github.com/gin-gonic/gin"
+	"github.com/mailgun/groupcache/v2"
+	log "github.com/sirupsen/logrus"
+)
+
+const blockKeySeparator = "#block"
+
+var (
+	cacheBlockSize int64
+
+	errBlockChanged = errors.New("object changed in S3 while reading cached blocks")
+)
+
+// parseCacheKey splits 'bucket#key' or 'bucket#key#blockN' cache keys. Object keys can't be
+// mistaken for blocks, as constructCacheKey escapes any '#' in them
+func parseCacheKey(cacheKey string) (bucket string, key string, block int64, isBlock bool) {
+	keySplit := strings.SplitN(cacheKey, "#", 3)
+	bucket = cacheKeyUnescaper.Replace(keySplit[0])
+	if len(keySplit) > 1 {
+		key = cacheKeyUnescaper.Replace(keySplit[1])
+	}
+
+	if cacheBlockSize > 0 && len(keySplit) > 2 {
+		if n, err := strconv.ParseInt(strings.TrimPrefix("#"+keySplit[2], blockKeySeparator), 10, 64); err == nil && n >= 0 {
+			return bucket, key, n, true
+		}
+	}
+	return bucket, key, 0, false
+}
+
+func constructBlockKey(bucket string, key string, block int64) string {
+	return fmt.Sprintf("%s%s%d", constructCacheKey(bucket, key), blockKeySeparator, block)
+}
+
+func blockBytes() int64 {
+	return cacheBlockSize << 20
+}
+
+func blockByteRange(block int64) string {
+	start := block * blockBytes()
+	return fmt.Sprintf("bytes=%d-%d", start, start+blockBytes()-1)
+}
+
+func blockCount(size int64) int64 {
+	return (size + blockBytes() - 1) / blockBytes()
+}
+
+// getCacheBlock returns a view of one block's bytes, checking it belongs to the expected object version
+func getCacheBlock(ctx context.Context, bucket string, key string, block int64, meta objectMetadata) (groupcache.ByteView, error) {
+	blockKey := constructBlockKey(bucket, key, block)
+	ctx, cancel := context.WithTimeout(ctx, time.Millisecond*time.Duration(timeout))
+	defer cancel()
+
+	blockMeta, body, err := cacheGet(ctx, blockKey)
+	if err != nil {
+		return body, err
+	}
+
+	expectedLen := blockBytes()
+	if remaining := meta.ContentLength - block*blockBytes(); remaining < expectedLen {
+		expectedLen = remaining
+	}
+	if blockMeta.ETag != meta.ETag || int64(body.Len()) != expectedLen {
+		log.Debugf("Cached block '%s' doesn't match object (etag %s != %s)", blockKey, blockMeta.ETag, meta.ETag)
+		return body, errBlockChanged
+	}
+	return body, nil
+}
+
+// blockReader streams a byte range of an object, pulling each block from the cache as it is reached
+type blockReader struct {
+	ctx     context.Context
+	bucket  string
+	key     string
+	meta    objectMetadata
+	offset  int64
+	end     int64
+	current groupcache.ByteView
+}
+
+func (r *blockReader) Read(p []byte) (int, error) {
+	if r.offset >= r.end {
+		return 0, io.EOF
+	}
+
+	if r.current.Len() == 0 {
+		block := r.offset / blockBytes()
+		body, err := getCacheBlock(r.ctx, r.bucket, r.key, block, r.meta)
+		if err != nil {
+			log.Errorf("Failed to read block %d of '%s' from cache: %v", block, constructCacheKey(r.bucket, r.key), err)
+			return 0, err
+		}
+		blockStart := block * blockBytes()
+		to := int64(body.Len())
+		if r.end-blockStart < to {
+			to = r.end - blockStart
+		}
+		r.current = body.Slice(int(r.offset-blockStart), int(to))
+	}
+
+	n := r.current.Copy(p)
+	r.current = r.current.SliceFrom(n)
+	r.offset += int64(n)
+	return n, nil
+}
+
+// serveCacheBlocks serves a blocked object, only pulling the blocks covering the requested range
+func serveCacheBlocks(c *gin.Context, bucket string, key string, meta objectMetadata,
+	defaultHeaders map[string]string, renderError errorRenderer) {
+	cacheKey := constructCacheKey(bucket, key)
+	size := meta.ContentLength
+	setMetadataHeaders(c, meta)
+	setDefaultHeaders(c, defaultHeaders)
+	c.Header("Accept-Ranges", "bytes")
+
+	if status := checkPreconditions(c, meta); status != 0 {
+		servePreconditionResult(c, status, renderError)
+		return
+	}
+
+	status := 200
+	start, length := int64(0), size
+	r, err := requestedRange(c, meta, size)
+	if err != nil {
+		c.Header("Content-Range", fmt.Sprintf("bytes */%d", size))
+		renderError(c, 416, "InvalidRange", fmt.Sprintf("Requested range not satisfiable: %v", err))
+		return
+	}
+	if r != nil {
+		status = 206
+		start, length = r.start, r.length
+	}
+
+	reader := &blockReader{
+		ctx:    c.Request.Context(),
+		bucket: bucket,
+		key:    key,
+		meta:   meta,
+		offset: start,
+		end:    start + length,
+	}
+
+	// Pull the first block before sending headers, so failures can still be reported
+	if length > 0 {
+		firstBlock := start / blockBytes()
+		body, err := getCacheBlock(reader.ctx, bucket, key, firstBlock, meta)
+		if err == errBlockChanged {
+			log.Debugf("'%s' changed in S3, invalidating cached blocks and streaming from S3", cacheKey)
+			cacheInvalidate(bucket, key)
+			s3Stream(c, bucket, key, defaultHeaders, renderError)
+			return
+		}
+		if err != nil {
+			renderCacheError(c, cacheKey, err, renderError)
+			return
+		}
+		blockStart := firstBlock * blockBytes()
+		to := int64(body.Len())
+		if reader.end-blockStart < to {
+			to = reader.end - blockStart
+		}
+		reader.current = body.Slice(int(start-blockStart), int(to))
+	}
+
+	if r != nil {
+		c.Header("Content-Range", r.contentRange(size))
+	}
+	log.Debugf("Sending '%s' bytes in response from %d cached block(s)", cacheKey, blockCount(size))
+	c.Header("Content-Type", meta.contentType())
+	c.Header("Content-Length", strconv.FormatInt(length, 10))
+	c.Status(status)
+	if _, err := io.Copy(c.Writer, reader); err != nil {
+		// Headers are already sent, so the client can only tell the body is incomplete if the
+		// connection is dropped
+		abortConnection(c)
+	}
+}
+
+// abortConnection closes the client connection of a response that can't be completed
+func abortConnection(c *gin.Context) {
+	c.Abort()
+	if conn, _, err := c.Writer.Hijack(); err == nil {
+		conn.Close()
+		return
+	}
+	panic(http.ErrAbortHandler)
+}
+
+// fetchBlocksToCache pre-warms every block of an object, returning the bytes cached and the
+// first error
+func fetchBlocksToCache(ctx context.Context, bucket string, key string, meta objectMetadata) (int64, error) {
+	blockPool := parallel.SmallJobPool()
+	defer blockPool.Close()
+
+	mu := sync.Mutex{}
+	var size int64
+	var firstErr error
+	for block := int64(0); block < blockCount(meta.ContentLength); block++ {
+		block := block
+		blockPool.AddJob(func() {
+			body, err := getCacheBlock(ctx, bucket, key, block, meta)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				log.Errorf("Failed to fetch block %d of '%s' to cache: %v", block, constructCacheKey(bucket, key), err)
+				if firstErr == nil {
+					firstErr = err
+				}
+				return
+			}
+			size += int64(body.Len())
+		})
+	}
+	blockPool.Wait()
+	return size, firstErr
+}
+
+// invalidateBlocks removes the cached blocks of an object, using its cached size to know how many there are
+func invalidateBlocks(bucket string, key string) error {
+	meta, err := cacheGetMetadata(bucket, key)
+	if err != nil || meta.ContentLength <= blockBytes() {
+		return nil
+	}
+
+	var firstErr error
+	for block := int64(0); block < blockCount(meta.ContentLength); block++ {
+		if err := removeCacheKey(constructBlockKey(bucket, key, block)); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	log.Debugf("Invalidated %d block(s) of '%s' from cache", blockCount(meta.ContentLength), constructCacheKey(bucket, key))
+	return firstErr
+}
@@ -5,67 +5,354 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/adrianchifor/go-parallel"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/gin-gonic/gin"
 	"github.com/mailgun/groupcache/v2"
 	log "github.com/sirupsen/logrus"
 )
 
 var (
-	peers        []string
-	cacheGroup   *groupcache.Group
-	cachePool    *groupcache.HTTPPool
-	maxCacheSize int64
-	ttl          int
-	timeout      int
+	errObjectTooLarge  = errors.New("object is larger than max-cacheable-object-size")
+	errCachingDisabled = errors.New("caching is disabled for this key by a TTL rule")
+)
+
+var (
+	cacheGroup           *resettableGroup
+	metadataGroup        *resettableGroup
+	cachePool            *groupcache.HTTPPool
+	maxCacheSize         int64
+	maxMetadataCacheSize int64
+	maxCacheableSize     int64
+	ttl                  int
+	negativeTTL          int
+	timeout              int
 )
 
 func initCachePool() {
-	cachePool = groupcache.NewHTTPPoolOpts(fmt.Sprintf("http://%s:%d", host, port),
-		&groupcache.HTTPPoolOptions{})
+	selfPeer = fmt.Sprintf("%s://%s:%d", peerScheme(), host, port)
+	cachePool = groupcache.NewHTTPPoolOpts(selfPeer,
+		&groupcache.HTTPPoolOptions{Transport: newPeerTransport})
+
+	initReplicas()
+	setPeers(nil)
+
+	cacheGroup = newResettableGroup("s3", maxCacheSize<<20, groupcache.GetterFunc(cacheFiller))
+	metadataGroup = newResettableGroup("s3-meta", maxMetadataCacheSize<<20, groupcache.GetterFunc(metadataFiller))
+}
+
+// resettableGroup is a groupcache group that can be emptied, by replacing it with a new one
+// under the same name. groupcache has no other way to drop keys it can't be told about
+type resettableGroup struct {
+	name   string
+	size   int64
+	getter groupcache.Getter
+
+	mu    sync.Mutex
+	group atomic.Value
+}
+
+func newResettableGroup(name string, size int64, getter groupcache.Getter) *resettableGroup {
+	g := &resettableGroup{name: name, size: size, getter: getter}
+	g.group.Store(groupcache.NewGroup(name, size, getter))
+	return g
+}
 
-	if len(peers) > 0 {
-		cachePool.Set(peers...)
+func (g *resettableGroup) current() *groupcache.Group {
+	return g.group.Load().(*groupcache.Group)
+}
+
+func (g *resettableGroup) Name() string {
+	return g.name
+}
+
+func (g *resettableGroup) Get(ctx context.Context, key string, dest groupcache.Sink) error {
+	return g.current().Get(ctx, key, dest)
+}
+
+// Remove drops a key from its owner, this node and every other peer. groupcache gives up on
+// the rest when the owner fails, e.g. while its circuit is open, so the key is then still
+// removed from this node and the other peers, returning the owner's error
+func (g *resettableGroup) Remove(ctx context.Context, key string) error {
+	err := g.current().Remove(ctx, key)
+	if err == nil {
+		return nil
+	}
+	log.Warnf("Failed to remove '%s' from its owner, removing it from the other peers: %v", key, err)
+
+	// groupcache only removes keys from this node when its pool serves a peer's DELETE
+	req := &http.Request{Method: http.MethodDelete, URL: &url.URL{Path: "/_groupcache/" + g.name + "/" + key}}
+	cachePool.ServeHTTP(httptest.NewRecorder(), req.WithContext(ctx))
+
+	owner := ownerOf(key) + "/_groupcache/"
+	errs := fanOut(func(peerURL string) error {
+		if peerURL == owner {
+			return nil
+		}
+		return peerRemove(ctx, peerURL, g.name, key)
+	})
+	if len(errs) > 0 {
+		return fmt.Errorf("%v, and from peer(s): %s", err, fanOutError(errs))
 	}
+	return err
+}
+
+func (g *resettableGroup) CacheStats(which groupcache.CacheType) groupcache.CacheStats {
+	return g.current().CacheStats(which)
+}
+
+// reset drops every entry of the group held by this node, including its stats
+func (g *resettableGroup) reset() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
 
-	cacheGroup = groupcache.NewGroup("s3", maxCacheSize<<20, groupcache.GetterFunc(cacheFiller))
+	groupcache.DeregisterGroup(g.name)
+	g.group.Store(groupcache.NewGroup(g.name, g.size, g.getter))
+}
+
+// resetCache drops everything this node holds in memory, for when it can't tell which keys to
+// invalidate. Disk cached keys are always known, so they're left to be invalidated by key
+func resetCache() {
+	cacheGroup.reset()
+	metadataGroup.reset()
+	localIndex.reset()
+	metadataIndex.reset()
+	replicas.reset()
+	log.Warn("Dropped every key held in memory from cache")
 }
 
 func cacheFiller(ctx context.Context, cacheKey string, dest groupcache.Sink) error {
+	if err := peerError(ctx); err != nil {
+		log.Debugf("Owner of '%s' failed to get it, not retrying from S3: %v", cacheKey, err)
+		return err
+	}
+	if ownerOnly(ctx) && ownerOf(cacheKey) != selfPeer {
+		return errPeerUnavailable
+	}
+	if fill, ok := pendingFills.Load(cacheKey); ok {
+		log.Debugf("Filling '%s' from refreshed entry", cacheKey)
+		fill := fill.(*pendingFill)
+		return storeCacheEntry(cacheKey, fill.entry, fill.meta, fill.expire, dest)
+	}
+	if diskCache != nil {
+		if entry, expire, found := diskCache.get(cacheKey); found {
+			return fillFromDisk(cacheKey, entry, expire, dest)
+		}
+	}
+
+	entry, meta, expire, err := loadCacheEntry(cacheKey, "")
+	if err == errNotFound && negativeTTL > 0 {
+		log.Debugf("'%s' not found in S3, caching miss for %ds", cacheKey, negativeTTL)
+		return fillNotFound(cacheKey, dest)
+	}
+	if err != nil {
+		return err
+	}
+	return storeCacheEntry(cacheKey, entry, meta, expire, dest)
+}
+
+// loadCacheEntry downloads a blob (or block) from S3 and encodes it with its metadata,
+// returning when the cached copy should expire. With ifNoneMatch set, errNotModified is
+// returned instead if the object still has that ETag
+func loadCacheEntry(cacheKey string, ifNoneMatch string) ([]byte, objectMetadata, time.Time, error) {
 	log.Debugf("Pulling '%s' into cache from S3", cacheKey)
-	keySplit := strings.Split(cacheKey, "#")
-	bucket := keySplit[0]
-	key := keySplit[1]
+	bucket, key, block, isBlock := parseCacheKey(cacheKey)
+	if cachingDisabledFor(bucket, key) {
+		return nil, objectMetadata{}, time.Time{}, errCachingDisabled
+	}
+	byteRange := ""
+	if isBlock {
+		byteRange = blockByteRange(block)
+	} else if _, mode := cacheModeFor(bucket, key); mode == cacheBypass {
+		return nil, objectMetadata{}, time.Time{}, errObjectTooLarge
+	}
+
 	buf := aws.NewWriteAtBuffer([]byte{})
-	err := s3Download(bucket, key, buf)
+	meta, err := s3Download(bucket, key, byteRange, ifNoneMatch, buf)
+	if reqErr, ok := err.(awserr.RequestFailure); ok && reqErr.StatusCode() == 304 {
+		log.Debugf("'%s' not modified in S3", cacheKey)
+		return nil, meta, time.Time{}, errNotModified
+	}
 	if err != nil {
-		log.Errorf("Failed to download '%s' from S3: %v", cacheKey, err)
-		return err
+		cerr := classifyError(err)
+		if cerr.Status >= 500 {
+			log.Errorf("Failed to download '%s' from S3: %v", cacheKey, err)
+		} else {
+			log.Debugf("Failed to download '%s' from S3: %v", cacheKey, err)
+		}
+		return nil, meta, time.Time{}, cerr
 	}
 
-	if ttl > 0 {
-		log.Debugf("Pulled '%s' into buffer, adding to cache with %dm TTL", cacheKey, ttl)
-		err = dest.SetBytes(buf.Bytes(), time.Now().Add(time.Minute*time.Duration(ttl)))
+	keyTTL := ttlFor(bucket, key)
+	if keyTTL > 0 {
+		log.Debugf("Pulled '%s' into buffer, adding to cache with %dm TTL", cacheKey, keyTTL)
 	} else {
-		// "Disable" TTL - expire in 10 years
 		log.Debugf("Pulled '%s' into buffer, adding to cache with 10 year TTL", cacheKey)
-		err = dest.SetBytes(buf.Bytes(), time.Now().Add(time.Hour*87650))
 	}
+	var expire time.Time
+	meta.FreshUntil, expire = entryExpiry(keyTTL, isBlock)
+
+	entry, err := encodeCacheEntry(meta, buf.Bytes())
 	if err != nil {
-		log.Errorf("Failed to fill cache sink with '%s': %v", key, err)
+		log.Errorf("Failed to encode metadata for '%s': %v", cacheKey, err)
+		return nil, meta, expire, err
+	}
+	return entry, meta, expire, nil
+}
+
+// entryExpiry returns when a new entry with a keyTTL minute TTL goes stale (zero if it doesn't) and when it's dropped from cache
+func entryExpiry(keyTTL int, isBlock bool) (time.Time, time.Time) {
+	expire := cacheExpiry(keyTTL)
+	if keyTTL > 0 && !isBlock && staleWindow() > 0 {
+		// Keep the entry past its TTL, so it can still be served or revalidated while refreshing
+		return expire, expire.Add(staleWindow())
+	}
+	return time.Time{}, expire
+}
+
+func storeCacheEntry(cacheKey string, entry []byte, meta objectMetadata, expire time.Time, dest groupcache.Sink) error {
+	if err := dest.SetBytes(entry, expire); err != nil {
+		log.Errorf("Failed to fill cache sink with '%s': %v", cacheKey, err)
 		return err
 	}
+	localIndex.add(cacheKey, meta, int64(len(entry)), expire)
+
+	if diskCache != nil {
+		// Written before groupcache holds the entry, so invalidating it from memory also finds it on disk
+		diskCache.put(cacheKey, entry, expire)
+	}
 
 	log.Debugf("Pulled '%s' into cache", cacheKey)
+	return nil
+}
+
+// fillNotFound caches a short-lived negative entry, so repeated misses aren't sent to S3. It's
+// indexed so prefix invalidations still find it, but not listed as a cached key
+func fillNotFound(cacheKey string, dest groupcache.Sink) error {
+	meta := objectMetadata{NotFound: true}
+	entry, err := encodeCacheEntry(meta, nil)
+	if err != nil {
+		return err
+	}
+	expire := time.Now().Add(time.Second * time.Duration(negativeTTL))
+	if err := dest.SetBytes(entry, expire); err != nil {
+		return err
+	}
+	localIndex.add(cacheKey, meta, int64(len(entry)), expire)
+	return nil
+}
 
+func fillFromDisk(cacheKey string, entry []byte, expire time.Time, dest groupcache.Sink) error {
+	meta, err := decodeCacheMetadata(entry)
+	if err != nil {
+		log.Errorf("Failed to decode disk cached '%s': %v", cacheKey, err)
+		diskCache.remove(cacheKey)
+		return err
+	}
+
+	log.Debugf("Pulled '%s' into cache from disk", cacheKey)
+	if err := dest.SetBytes(entry, expire); err != nil {
+		log.Errorf("Failed to fill cache sink with '%s': %v", cacheKey, err)
+		return err
+	}
+	localIndex.add(cacheKey, meta, int64(len(entry)), expire)
+	return nil
+}
+
+func metadataFiller(ctx context.Context, cacheKey string, dest groupcache.Sink) error {
+	if err := peerError(ctx); err != nil {
+		return err
+	}
+	bucket, key, _, _ := parseCacheKey(cacheKey)
+	if cachingDisabledFor(bucket, key) {
+		return errCachingDisabled
+	}
+
+	// Same key as the blob group, so this node also owns the blob if it was cached
+	meta, expire := objectMetadata{}, cacheExpiry(ttlFor(bucket, key))
+	if entry, found := localIndex.get(cacheKey); found {
+		log.Debugf("Filling metadata for '%s' from cached blob", cacheKey)
+		meta, expire = entry.meta, entry.expire
+	} else {
+		log.Debugf("Pulling metadata for '%s' into cache from S3", cacheKey)
+		res, err := s3Client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		})
+		if err != nil && isNotFoundErr(err) && negativeTTL > 0 {
+			log.Debugf("'%s' not found in S3, caching metadata miss for %ds", cacheKey, negativeTTL)
+			meta = objectMetadata{NotFound: true}
+			expire = time.Now().Add(time.Second * time.Duration(negativeTTL))
+		} else if err != nil {
+			log.Debugf("Failed to get metadata for '%s' from S3: %v", cacheKey, err)
+			return classifyError(err)
+		} else {
+			meta = metadataFromHeadObject(res)
+		}
+	}
+
+	metaBytes, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	if err := dest.SetBytes(metaBytes, expire); err != nil {
+		return err
+	}
+	metadataIndex.add(cacheKey, meta, int64(len(metaBytes)), expire)
 	return nil
 }
 
+func cacheGetMetadata(bucket string, key string) (objectMetadata, error) {
+	meta := objectMetadata{}
+	cacheKey := constructCacheKey(bucket, key)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*time.Duration(timeout))
+	defer cancel()
+
+	ctx = withPeerErrorSlot(ctx)
+	var metaView groupcache.ByteView
+	if err := metadataGroup.Get(ctx, cacheKey, groupcache.ByteViewSink(&metaView)); err != nil {
+		return meta, err
+	}
+	if err := json.Unmarshal(metaView.ByteSlice(), &meta); err != nil {
+		return meta, err
+	}
+	if meta.NotFound {
+		return meta, errNotFound
+	}
+	return meta, nil
+}
+
+// cacheGet returns the metadata and a view of the blob bytes for a cache key
+func cacheGet(ctx context.Context, cacheKey string) (objectMetadata, groupcache.ByteView, error) {
+	ctx = withPeerErrorSlot(ctx)
+	cacheView, err := replicatedGet(ctx, cacheKey)
+	if err != nil {
+		return objectMetadata{}, cacheView, err
+	}
+	meta, body, err := decodeCacheEntry(cacheView)
+	if err != nil {
+		log.Errorf("Failed to decode cached '%s': %v", cacheKey, err)
+		return meta, body, errCorruptCacheEntry
+	}
+	if meta.NotFound {
+		return meta, body, errNotFound
+	}
+	localIndex.hit(cacheKey)
+	return meta, body, nil
+}
+
 func restCacheGet(c *gin.Context) {
 	bucket := strings.TrimSpace(c.Query("bucket"))
 	if bucket == "" {
@@ -79,66 +366,74 @@ func restCacheGet(c *gin.Context) {
 	}
 
 	cacheKey := constructCacheKey(bucket, key)
+	switch meta, mode := cacheModeFor(bucket, key); mode {
+	case cacheBypass:
+		s3Stream(c, bucket, key, restGetHeaders(key), restError)
+		return
+	case cacheBlocks:
+		serveCacheBlocks(c, bucket, key, meta, restGetHeaders(key), restError)
+		return
+	}
+
 	log.Debugf("Checking cache for '%s'", cacheKey)
 	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*time.Duration(timeout))
 	defer cancel()
 
-	var cacheView groupcache.ByteView
-	if err := cacheGroup.Get(ctx, cacheKey, groupcache.ByteViewSink(&cacheView)); err != nil {
-		c.JSON(404, gin.H{"error": fmt.Sprintf("Blob '%s' not found", cacheKey)})
+	meta, body, stale, err := cacheGetServable(ctx, cacheKey)
+	if err != nil {
+		renderCacheError(c, cacheKey, err, restError)
 		return
 	}
+	if stale {
+		c.Header("X-Cache", "STALE")
+	}
 
-	extraHeaders := map[string]string{
+	log.Debugf("Sending '%s' bytes in response", cacheKey)
+	serveCacheEntry(c, meta, body, restGetHeaders(key), restError)
+}
+
+// restGetHeaders are the /get response headers used when S3 didn't set them
+func restGetHeaders(key string) map[string]string {
+	return map[string]string{
 		"Content-Disposition": fmt.Sprintf(`attachment; filename="%s"`, key),
 	}
-	log.Debugf("Sending '%s' bytes in response", cacheKey)
-	c.DataFromReader(200, int64(cacheView.Len()), "application/octet-stream", cacheView.Reader(), extraHeaders)
 }
 
-func restCachePrewarm(c *gin.Context) {
-	bucket := strings.TrimSpace(c.Query("bucket"))
-	if bucket == "" {
-		c.JSON(400, gin.H{"error": "'bucket' not found in querystring parameters"})
-		return
+type cacheMode int
+
+const (
+	cacheWhole cacheMode = iota
+	cacheBlocks
+	cacheBypass
+)
+
+// cacheModeFor decides whether an object is cached whole, cached in blocks or streamed from S3,
+// only looking up its metadata when a size limit is configured
+func cacheModeFor(bucket string, key string) (objectMetadata, cacheMode) {
+	if cachingDisabledFor(bucket, key) {
+		log.Debugf("Caching disabled for '%s' by TTL rule, streaming from S3", constructCacheKey(bucket, key))
+		cacheBypassMetric.WithLabelValues("no_cache").Inc()
+		return objectMetadata{}, cacheBypass
 	}
-	prefix := strings.TrimSpace(c.Query("prefix"))
-	if prefix == "" {
-		c.JSON(400, gin.H{"error": "'prefix' not found in querystring parameters"})
-		return
+	if maxCacheableSize <= 0 && cacheBlockSize <= 0 {
+		return objectMetadata{}, cacheWhole
 	}
 
-	log.Debugf("Pre-warming cache with prefix '%s#%s'", bucket, prefix)
-	keys, err := s3ListKeys(bucket, prefix, "")
+	meta, err := cacheGetMetadata(bucket, key)
 	if err != nil {
-		msg := fmt.Sprintf("Failed to list keys with prefix '%s' in S3 bucket '%s': %v", prefix, bucket, err)
-		log.Errorf(msg)
-		c.JSON(500, gin.H{"error": msg})
-		return
+		return meta, cacheWhole
 	}
-	if len(keys) == 0 {
-		c.JSON(404, gin.H{"error": fmt.Sprintf("No keys found with prefix '%s' in S3 bucket '%s'", prefix, bucket)})
-		return
-	}
-
-	go func() {
-		getPool := parallel.SmallJobPool()
-		defer getPool.Close()
 
-		for _, key := range keys {
-			key := key
-			// Prewarm 10 keys at a time
-			getPool.AddJob(func() {
-				log.Debugf("Pre-warming cache for '%s'", constructCacheKey(bucket, key))
-				fetchToCache(bucket, key)
-			})
-		}
-	}()
-
-	c.JSON(200, gin.H{
-		"message": fmt.Sprintf("Pre-warming cache in the background with prefix '%s' from S3 bucket '%s'", prefix, bucket),
-		"error":   "",
-	})
+	if maxCacheableSize > 0 && meta.ContentLength > maxCacheableSize<<20 {
+		log.Debugf("'%s' is %d bytes, above max-cacheable-object-size, streaming from S3",
+			constructCacheKey(bucket, key), meta.ContentLength)
+		cacheBypassMetric.WithLabelValues("too_large").Inc()
+		return meta, cacheBypass
+	}
+	if cacheBlockSize > 0 && meta.ContentLength > cacheBlockSize<<20 {
+		return meta, cacheBlocks
+	}
+	return meta, cacheWhole
 }
 
 func restCacheInvalidate(c *gin.Context) {
@@ -148,32 +443,101 @@ func restCacheInvalidate(c *gin.Context) {
 		return
 	}
 	key := strings.TrimSpace(c.Query("key"))
-	if key == "" {
-		c.JSON(400, gin.H{"error": "'key' not found in querystring parameters"})
+	prefix := strings.TrimSpace(c.Query("prefix"))
+	if key == "" && prefix == "" {
+		c.JSON(400, gin.H{"error": "'key' or 'prefix' not found in querystring parameters"})
+		return
+	}
+	if key != "" && prefix != "" {
+		c.JSON(400, gin.H{"error": "Only provide one of 'key' or 'prefix' in querystring parameters"})
+		return
+	}
+
+	if prefix != "" {
+		restCacheInvalidatePrefix(c, bucket, prefix)
 		return
 	}
 
-	cacheInvalidate(bucket, key)
+	if err := cacheInvalidate(bucket, key); err != nil {
+		msg := fmt.Sprintf("Failed to invalidate '%s' from cache: %v", constructCacheKey(bucket, key), err)
+		log.Errorf(msg)
+		c.JSON(500, gin.H{"error": msg})
+		return
+	}
 	c.JSON(200, gin.H{
 		"message": fmt.Sprintf("'%s' invalidated from cache", constructCacheKey(bucket, key)),
 		"error":   "",
 	})
 }
 
-func cacheInvalidate(bucket string, key string) {
+func cacheInvalidate(bucket string, key string) error {
 	cacheKey := constructCacheKey(bucket, key)
-	cacheGroup.Remove(context.Background(), cacheKey)
+	var blocksErr error
+	if cacheBlockSize > 0 {
+		blocksErr = invalidateBlocks(bucket, key)
+	}
+	if err := removeCacheKey(cacheKey); err != nil {
+		return err
+	}
+	if blocksErr != nil {
+		return blocksErr
+	}
 	log.Debugf("'%s' invalidated from cache", cacheKey)
+	return nil
 }
 
-func fetchToCache(bucket string, key string) {
+// removeCacheKey drops a blob or block key from this node's index and disk, and from every peer's memory
+func removeCacheKey(cacheKey string) error {
+	localIndex.remove(cacheKey)
+	metadataIndex.remove(cacheKey)
+	replicas.remove(cacheKey)
+	if diskCache != nil {
+		diskCache.remove(cacheKey)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Millisecond)
+	defer cancel()
+	err := cacheGroup.Remove(ctx, cacheKey)
+	if _, _, _, isBlock := parseCacheKey(cacheKey); !isBlock {
+		if metaErr := metadataGroup.Remove(ctx, cacheKey); err == nil {
+			err = metaErr
+		}
+	}
+	return err
+}
+
+// serveGroupcache handles peer traffic, also counting peer gets of keys in the local index and
+// dropping keys removed by peers from the local index and disk
+func serveGroupcache(c *gin.Context) {
+	if c.Request.Method == http.MethodDelete {
+		cacheKey := strings.TrimPrefix(c.Param("blob"), "/")
+		localIndex.remove(cacheKey)
+		metadataIndex.remove(cacheKey)
+		replicas.remove(cacheKey)
+		if diskCache != nil {
+			diskCache.remove(cacheKey)
+		}
+	} else if strings.HasPrefix(c.Request.URL.Path, "/_groupcache/s3/") {
+		localIndex.hit(strings.TrimPrefix(c.Param("blob"), "/"))
+	}
+	cachePool.ServeHTTP(c.Writer, c.Request)
+}
+
+// fetchToCache loads a key (or its blocks) into the cache, returning how many bytes it holds
+func fetchToCache(ctx context.Context, bucket string, key string) (int64, error) {
 	cacheKey := constructCacheKey(bucket, key)
 	log.Debugf("Fetching key to cache '%s'", cacheKey)
-	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*time.Duration(timeout))
+	if meta, mode := cacheModeFor(bucket, key); mode == cacheBlocks {
+		return fetchBlocksToCache(ctx, bucket, key, meta)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Millisecond*time.Duration(timeout))
 	defer cancel()
 
-	var tmpCacheView groupcache.ByteView
-	if err := cacheGroup.Get(ctx, cacheKey, groupcache.ByteViewSink(&tmpCacheView)); err != nil {
+	_, body, err := cacheGet(ctx, cacheKey)
+	if err != nil {
 		log.Errorf("Failed to fetch key to cache '%s': %v", cacheKey, err)
+		return 0, err
 	}
+	return int64(body.Len()), nil
 }
@@ -130,4 +130,10 @@ cachenator env vars
 {{- with .Values.envVars -}}
 {{ toYaml . | nindent 12 }}
 {{- end -}}
+{{- if or .Values.discovery.dns.enabled .Values.discovery.kubernetes.enabled }}
+            - name: POD_IP
+              valueFrom:
+                fieldRef:
+                  fieldPath: status.podIP
+{{- end -}}
 {{- end -}}
\ No newline at end of file
@@ -0,0 +1,270 @@
+// SPDX-FileCopyrightText: 2022 Marshall Wace <opensource@mwam.com>
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/segmentio/fasthash/fnv1"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// selfPeer is this node's URL as it appears in the peers list
+	selfPeer string
+	// peers are the current cluster members, staticPeers the ones from -peers (or the admin API)
+	// which are always kept alongside discoveredPeers
+	peers           []string
+	staticPeers     []string
+	discoveredPeers []string
+	peersMu         sync.Mutex
+	// ring mirrors the groupcache ring of peers, to find the replicas of keys
+	ring = newOwnerRing(nil)
+)
+
+// groupcache's default number of points per peer on its consistent hash ring
+const ringReplicas = 50
+
+// ownerRing is a copy of groupcache's consistent hash ring (consistenthash.Map with its default
+// hash), which doesn't expose the peers following a key's owner
+type ownerRing struct {
+	hashes []int
+	peers  map[int]string
+}
+
+func newOwnerRing(members []string) *ownerRing {
+	r := &ownerRing{peers: map[int]string{}}
+	for _, peer := range members {
+		for i := 0; i < ringReplicas; i++ {
+			hash := int(fnv1.HashBytes64([]byte(fmt.Sprintf("%x", md5.Sum([]byte(strconv.Itoa(i)+peer))))))
+			r.hashes = append(r.hashes, hash)
+			r.peers[hash] = peer
+		}
+	}
+	sort.Ints(r.hashes)
+	return r
+}
+
+// owners returns up to n distinct peers clockwise from a key, the first being its groupcache owner
+func (r *ownerRing) owners(key string, n int) []string {
+	owners := []string{}
+	if len(r.hashes) == 0 {
+		return owners
+	}
+	hash := int(fnv1.HashBytes64([]byte(key)))
+	start := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= hash })
+	for i := 0; i < len(r.hashes) && len(owners) < n; i++ {
+		peer := r.peers[r.hashes[(start+i)%len(r.hashes)]]
+		if !containsString(owners, peer) {
+			owners = append(owners, peer)
+		}
+	}
+	return owners
+}
+
+// setPeers replaces the discovered peers, updating the cluster membership
+func setPeers(discovered []string) {
+	peersMu.Lock()
+	defer peersMu.Unlock()
+	discoveredPeers = discovered
+	updatePeers()
+}
+
+// setStaticPeers replaces the peers kept alongside discovered ones, updating the cluster membership
+func setStaticPeers(static []string) {
+	peersMu.Lock()
+	defer peersMu.Unlock()
+	staticPeers = static
+	updatePeers()
+}
+
+// updatePeers sets the cluster membership to this node, the static and the discovered peers,
+// logging peers joining and leaving. peersMu must be held
+func updatePeers() {
+	seen := map[string]bool{}
+	members := []string{}
+	for _, peer := range append(append([]string{selfPeer}, staticPeers...), discoveredPeers...) {
+		if !seen[peer] {
+			seen[peer] = true
+			members = append(members, peer)
+		}
+	}
+	sort.Strings(members)
+
+	if len(peers) == 0 {
+		log.Infof("Cluster peers: %s", strings.Join(members, ", "))
+	} else {
+		previous := map[string]bool{}
+		left := []string{}
+		for _, peer := range peers {
+			previous[peer] = true
+			if !seen[peer] {
+				log.Infof("Peer %s left the cluster", peer)
+				left = append(left, peer)
+			}
+		}
+		forgetPeerCircuits(left)
+		changed := len(peers) != len(members)
+		for _, peer := range members {
+			if !previous[peer] {
+				log.Infof("Peer %s joined the cluster", peer)
+				changed = true
+			}
+		}
+		if !changed {
+			return
+		}
+	}
+	peers = members
+	ring = newOwnerRing(peers)
+	cachePool.Set(peers...)
+}
+
+// peerCount returns the number of cluster members, including this node
+func peerCount() int {
+	peersMu.Lock()
+	defer peersMu.Unlock()
+	return len(peers)
+}
+
+// currentPeers returns the cluster members and the static peers among them
+func currentPeers() ([]string, []string) {
+	peersMu.Lock()
+	defer peersMu.Unlock()
+	return append([]string{}, peers...), append([]string{}, staticPeers...)
+}
+
+// otherPeers returns the base URLs ('http://peer:8080/_groupcache/') of every peer but this node
+func otherPeers() []string {
+	peerURLs := []string{}
+	for _, peer := range cachePool.GetAll() {
+		if peerURL := peer.GetURL(); !strings.HasPrefix(peerURL, selfPeer+"/") {
+			peerURLs = append(peerURLs, peerURL)
+		}
+	}
+	return peerURLs
+}
+
+// ownerOf returns the URL of the peer owning a cache key in the consistent hash ring
+func ownerOf(cacheKey string) string {
+	if peer, ok := cachePool.PickPeer(cacheKey); ok {
+		return strings.TrimSuffix(peer.GetURL(), "/_groupcache/")
+	}
+	return selfPeer
+}
+
+// keyOwners returns the peers owning a cache key, its groupcache owner followed by its
+// -replication-factor - 1 replicas
+func keyOwners(cacheKey string) []string {
+	peersMu.Lock()
+	defer peersMu.Unlock()
+	if len(peers) == 0 {
+		return []string{selfPeer}
+	}
+	return ring.owners(cacheKey, replicationFactor)
+}
+
+// fanOut runs a request against every other peer in parallel, returning errors by peer URL
+func fanOut(request func(peerURL string) error) map[string]error {
+	mu := sync.Mutex{}
+	errs := map[string]error{}
+	wg := sync.WaitGroup{}
+	for _, peerURL := range otherPeers() {
+		wg.Add(1)
+		go func(peerURL string) {
+			defer wg.Done()
+			if err := request(peerURL); err != nil {
+				mu.Lock()
+				errs[peerURL] = err
+				mu.Unlock()
+			}
+		}(peerURL)
+	}
+	wg.Wait()
+	return errs
+}
+
+// peerJSON calls a peer's internal API, sending in (if not nil) and decoding the JSON response
+// into out
+func peerJSON(ctx context.Context, method string, url string, in interface{}, out interface{}) error {
+	return peerJSONAuthorized(ctx, method, url, "", in, out)
+}
+
+// peerJSONAuthorized is peerJSON forwarding a client's Authorization header, if any
+func peerJSONAuthorized(ctx context.Context, method string, url string, authorization string, in interface{}, out interface{}) error {
+	var reqBody io.Reader
+	if in != nil {
+		content, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(content)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, reqBody)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	res, err := peerClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("peer returned %d: %s", res.StatusCode, strings.TrimSpace(string(body)))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(body, out)
+}
+
+// peerRemove drops a key from a peer's memory, like groupcache does from the key's owner
+func peerRemove(ctx context.Context, peerURL string, group string, key string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete,
+		peerURL+url.QueryEscape(group)+"/"+url.QueryEscape(key), nil)
+	if err != nil {
+		return err
+	}
+	res, err := peerClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("peer returned %d", res.StatusCode)
+	}
+	return nil
+}
+
+// fanOutError summarises failed peers for an API error message
+func fanOutError(errs map[string]error) string {
+	failures := []string{}
+	for peerURL, err := range errs {
+		failures = append(failures, fmt.Sprintf("%s: %v", strings.TrimSuffix(peerURL, "/_groupcache/"), err))
+	}
+	return strings.Join(failures, "; ")
+}
@@ -0,0 +1,87 @@
+// SPDX-FileCopyrightText: 2022 Marshall Wace <opensource@mwam.com>
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// checkPreconditions evaluates conditional request headers (RFC 7232 section 6) against
+// the cached object, returning 304 or 412 if the request shouldn't be served, 0 otherwise
+func checkPreconditions(c *gin.Context, meta objectMetadata) int {
+	lastModified := meta.LastModified.UTC().Truncate(time.Second)
+
+	if ifMatch := c.GetHeader("If-Match"); ifMatch != "" {
+		if !etagListMatches(ifMatch, meta.ETag, false) {
+			return http.StatusPreconditionFailed
+		}
+	} else if since, ok := parseConditionalDate(c.GetHeader("If-Unmodified-Since")); ok {
+		if !meta.LastModified.IsZero() && lastModified.After(since) {
+			return http.StatusPreconditionFailed
+		}
+	}
+
+	if ifNoneMatch := c.GetHeader("If-None-Match"); ifNoneMatch != "" {
+		if etagListMatches(ifNoneMatch, meta.ETag, true) {
+			return http.StatusNotModified
+		}
+	} else if since, ok := parseConditionalDate(c.GetHeader("If-Modified-Since")); ok {
+		if !meta.LastModified.IsZero() && !lastModified.After(since) {
+			return http.StatusNotModified
+		}
+	}
+
+	return 0
+}
+
+// servePreconditionResult writes the 304/412 response for a failed precondition check
+func servePreconditionResult(c *gin.Context, status int, renderError errorRenderer) {
+	if status == http.StatusNotModified {
+		c.Status(http.StatusNotModified)
+		return
+	}
+	renderError(c, status, "PreconditionFailed", "At least one of the pre-conditions you specified did not hold")
+}
+
+// etagListMatches checks a comma separated If-Match/If-None-Match list, using weak
+// comparison for If-None-Match and strong comparison for If-Match
+func etagListMatches(header string, etag string, weak bool) bool {
+	if etag == "" {
+		return false
+	}
+	if strings.TrimSpace(header) == "*" {
+		return true
+	}
+
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if strings.HasPrefix(candidate, "W/") && !weak {
+			continue
+		}
+		if normalizeETag(candidate) == normalizeETag(etag) {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeETag strips the weak prefix and quotes, as SDKs don't always quote ETags they send back
+func normalizeETag(etag string) string {
+	return strings.Trim(strings.TrimPrefix(etag, "W/"), `"`)
+}
+
+func parseConditionalDate(header string) (time.Time, bool) {
+	if header == "" {
+		return time.Time{}, false
+	}
+	date, err := http.ParseTime(header)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return date.UTC(), true
+}
@@ -0,0 +1,72 @@
+// SPDX-FileCopyrightText: 2022 Marshall Wace <opensource@mwam.com>
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	peersDNS         string
+	peersDNSInterval int
+)
+
+// discoverPeersDNS periodically resolves -peers-dns and updates the cluster membership. Failed
+// lookups keep the current peers, so a DNS blip doesn't reshard the cache
+func discoverPeersDNS() {
+	for {
+		discovered, err := resolvePeersDNS(peersDNS)
+		if err != nil {
+			log.Errorf("Failed to discover peers from '%s': %v", peersDNS, err)
+		} else {
+			setPeers(discovered)
+		}
+		time.Sleep(time.Second * time.Duration(peersDNSInterval))
+	}
+}
+
+// resolvePeersDNS returns peer URLs from a name's SRV records if it starts with '_'
+// ('_http._tcp.cachenator.ns.svc'), else from its A/AAAA records on the server port.
+// Addresses are used over hostnames so -host can be set to the pod IP to identify self
+func resolvePeersDNS(name string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if !strings.HasPrefix(name, "_") {
+		addrs, err := net.DefaultResolver.LookupHost(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		return peerURLs(addrs, port), nil
+	}
+
+	_, records, err := net.DefaultResolver.LookupSRV(ctx, "", "", name)
+	if err != nil {
+		return nil, err
+	}
+	discovered := []string{}
+	for _, record := range records {
+		addrs, err := net.DefaultResolver.LookupHost(ctx, record.Target)
+		if err != nil {
+			return nil, fmt.Errorf("resolving SRV target '%s': %v", record.Target, err)
+		}
+		discovered = append(discovered, peerURLs(addrs, int(record.Port))...)
+	}
+	return discovered, nil
+}
+
+func peerURLs(addrs []string, peerPort int) []string {
+	urls := []string{}
+	for _, addr := range addrs {
+		urls = append(urls, peerScheme()+"://"+net.JoinHostPort(addr, strconv.Itoa(peerPort)))
+	}
+	return urls
+}
@@ -0,0 +1,360 @@
+// SPDX-FileCopyrightText: 2022 Marshall Wace <opensource@mwam.com>
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mailgun/groupcache/v2"
+	log "github.com/sirupsen/logrus"
+)
+
+// Disk cache files are laid out as
+// <magic><expire unix nanos><sha256 of payload><key length><key><payload>,
+// where the payload is the encoded cache entry (blob bytes + metadata)
+var diskCacheMagic = []byte("CNTR")
+
+const (
+	diskCacheFileSuffix = ".blob"
+	diskCacheHeaderSize = 4 + 8 + sha256.Size + 4
+)
+
+var (
+	diskCacheDir  string
+	diskCacheSize int64
+	diskCache     *diskTier
+
+	errDiskCacheCorrupt = errors.New("corrupt disk cache file")
+)
+
+// diskTier is an LRU blob cache on local disk, consulted before S3 when filling the in-memory cache
+type diskTier struct {
+	dir      string
+	maxBytes int64
+
+	mu      sync.Mutex
+	ll      *list.List
+	entries map[string]*list.Element
+	nbytes  int64
+
+	Stats diskTierStats
+}
+
+type diskTierStats struct {
+	Hits      groupcache.AtomicInt
+	Misses    groupcache.AtomicInt
+	Evictions groupcache.AtomicInt
+	Corrupted groupcache.AtomicInt
+}
+
+type diskEntry struct {
+	cacheKey string
+	path     string
+	size     int64
+}
+
+func initDiskCache() {
+	if diskCacheDir == "" {
+		return
+	}
+
+	var err error
+	diskCache, err = newDiskTier(diskCacheDir, diskCacheSize<<20)
+	if err != nil {
+		log.Fatalf("Failed to initialize disk cache in '%s': %v", diskCacheDir, err)
+	}
+	log.Infof("Disk cache loaded %d blob(s) (%d bytes) from '%s'", diskCache.items(), diskCache.bytes(), diskCacheDir)
+}
+
+func newDiskTier(dir string, maxBytes int64) (*diskTier, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+
+	d := &diskTier{
+		dir:      dir,
+		maxBytes: maxBytes,
+		ll:       list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+	if err := d.load(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// load rebuilds the LRU from files left by a previous run, oldest access first
+func (d *diskTier) load() error {
+	files, err := ioutil.ReadDir(d.dir)
+	if err != nil {
+		return err
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().Before(files[j].ModTime())
+	})
+
+	for _, file := range files {
+		path := filepath.Join(d.dir, file.Name())
+		if file.IsDir() || !strings.HasSuffix(file.Name(), diskCacheFileSuffix) {
+			// Leftover temp files from interrupted writes
+			if strings.HasSuffix(file.Name(), ".tmp") {
+				os.Remove(path)
+			}
+			continue
+		}
+
+		cacheKey, expire, err := readDiskCacheHeader(path)
+		if err != nil || time.Now().After(expire) || d.filePath(cacheKey) != path {
+			log.Debugf("Removing stale or unreadable disk cache file '%s'", path)
+			os.Remove(path)
+			continue
+		}
+
+		d.entries[cacheKey] = d.ll.PushFront(&diskEntry{cacheKey, path, file.Size()})
+		d.nbytes += file.Size()
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.evict()
+	return nil
+}
+
+func (d *diskTier) filePath(cacheKey string) string {
+	sum := sha256.Sum256([]byte(cacheKey))
+	return filepath.Join(d.dir, hex.EncodeToString(sum[:])+diskCacheFileSuffix)
+}
+
+// get returns the cached payload and its expiry, validating the checksum
+func (d *diskTier) get(cacheKey string) ([]byte, time.Time, bool) {
+	d.mu.Lock()
+	el, ok := d.entries[cacheKey]
+	if ok {
+		d.ll.MoveToFront(el)
+	}
+	d.mu.Unlock()
+	if !ok {
+		d.Stats.Misses.Add(1)
+		return nil, time.Time{}, false
+	}
+
+	path := el.Value.(*diskEntry).path
+	payload, expire, err := readDiskCacheFile(path, cacheKey)
+	if err != nil {
+		if err == errDiskCacheCorrupt {
+			d.Stats.Corrupted.Add(1)
+		}
+		log.Errorf("Failed to read '%s' from disk cache: %v", cacheKey, err)
+		d.removeIfCurrent(cacheKey, el)
+		d.Stats.Misses.Add(1)
+		return nil, time.Time{}, false
+	}
+	if time.Now().After(expire) {
+		log.Debugf("Disk cached '%s' has expired", cacheKey)
+		d.removeIfCurrent(cacheKey, el)
+		d.Stats.Misses.Add(1)
+		return nil, time.Time{}, false
+	}
+
+	// Keep access order across restarts
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	d.Stats.Hits.Add(1)
+	return payload, expire, true
+}
+
+func (d *diskTier) put(cacheKey string, payload []byte, expire time.Time) {
+	size := int64(diskCacheHeaderSize + len(cacheKey) + len(payload))
+	if size > d.maxBytes {
+		log.Debugf("'%s' is larger than the disk cache, not writing it to disk", cacheKey)
+		return
+	}
+
+	path := d.filePath(cacheKey)
+	if err := writeDiskCacheFile(path, cacheKey, payload, expire); err != nil {
+		log.Errorf("Failed to write '%s' to disk cache: %v", cacheKey, err)
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if el, ok := d.entries[cacheKey]; ok {
+		d.nbytes -= el.Value.(*diskEntry).size
+		d.ll.Remove(el)
+	}
+	d.entries[cacheKey] = d.ll.PushFront(&diskEntry{cacheKey, path, size})
+	d.nbytes += size
+	d.evict()
+}
+
+func (d *diskTier) remove(cacheKey string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if el, ok := d.entries[cacheKey]; ok {
+		d.removeElement(el)
+	}
+}
+
+// removeIfCurrent removes a key only if it's still the entry that was read, not one put since
+func (d *diskTier) removeIfCurrent(cacheKey string, read *list.Element) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if el, ok := d.entries[cacheKey]; ok && el == read {
+		d.removeElement(el)
+	}
+}
+
+// evict drops least recently used files until under the size limit, mu must be held
+func (d *diskTier) evict() {
+	for d.nbytes > d.maxBytes && d.ll.Len() > 0 {
+		entry := d.ll.Back().Value.(*diskEntry)
+		log.Debugf("Evicting '%s' from disk cache", entry.cacheKey)
+		d.removeElement(d.ll.Back())
+		d.Stats.Evictions.Add(1)
+	}
+}
+
+func (d *diskTier) removeElement(el *list.Element) {
+	entry := el.Value.(*diskEntry)
+	d.ll.Remove(el)
+	delete(d.entries, entry.cacheKey)
+	d.nbytes -= entry.size
+	if err := os.Remove(entry.path); err != nil && !os.IsNotExist(err) {
+		log.Errorf("Failed to remove disk cache file '%s': %v", entry.path, err)
+	}
+}
+
+func (d *diskTier) contains(cacheKey string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	_, ok := d.entries[cacheKey]
+	return ok
+}
+
+// keys returns the cache keys held on disk
+func (d *diskTier) keys() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	keys := make([]string, 0, len(d.entries))
+	for cacheKey := range d.entries {
+		keys = append(keys, cacheKey)
+	}
+	return keys
+}
+
+func (d *diskTier) bytes() int64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.nbytes
+}
+
+func (d *diskTier) items() int64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return int64(d.ll.Len())
+}
+
+func writeDiskCacheFile(path string, cacheKey string, payload []byte, expire time.Time) error {
+	sum := sha256.Sum256(payload)
+	header := make([]byte, diskCacheHeaderSize, diskCacheHeaderSize+len(cacheKey))
+	copy(header, diskCacheMagic)
+	binary.BigEndian.PutUint64(header[4:], uint64(expire.UnixNano()))
+	copy(header[12:], sum[:])
+	binary.BigEndian.PutUint32(header[12+sha256.Size:], uint32(len(cacheKey)))
+	header = append(header, cacheKey...)
+
+	// Write to a temp file and rename, so readers never see partial files
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "write-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(header); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(payload); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func parseDiskCacheHeader(header []byte) (expire time.Time, sum []byte, keyLen int, err error) {
+	if len(header) < diskCacheHeaderSize || !bytes.Equal(header[:4], diskCacheMagic) {
+		return time.Time{}, nil, 0, errDiskCacheCorrupt
+	}
+	expire = time.Unix(0, int64(binary.BigEndian.Uint64(header[4:])))
+	sum = header[12 : 12+sha256.Size]
+	keyLen = int(binary.BigEndian.Uint32(header[12+sha256.Size:]))
+	return expire, sum, keyLen, nil
+}
+
+func readDiskCacheHeader(path string) (string, time.Time, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	defer f.Close()
+
+	header := make([]byte, diskCacheHeaderSize)
+	if _, err := io.ReadFull(f, header); err != nil {
+		return "", time.Time{}, errDiskCacheCorrupt
+	}
+	expire, _, keyLen, err := parseDiskCacheHeader(header)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	key := make([]byte, keyLen)
+	if _, err := io.ReadFull(f, key); err != nil {
+		return "", time.Time{}, errDiskCacheCorrupt
+	}
+	return string(key), expire, nil
+}
+
+func readDiskCacheFile(path string, cacheKey string) ([]byte, time.Time, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	expire, sum, keyLen, err := parseDiskCacheHeader(content)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if len(content) < diskCacheHeaderSize+keyLen {
+		return nil, time.Time{}, errDiskCacheCorrupt
+	}
+	if key := string(content[diskCacheHeaderSize : diskCacheHeaderSize+keyLen]); key != cacheKey {
+		return nil, time.Time{}, fmt.Errorf("disk cache file holds '%s'", key)
+	}
+
+	payload := content[diskCacheHeaderSize+keyLen:]
+	actual := sha256.Sum256(payload)
+	if !bytes.Equal(actual[:], sum) {
+		return nil, time.Time{}, errDiskCacheCorrupt
+	}
+	return payload, expire, nil
+}
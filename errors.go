@@ -0,0 +1,198 @@
+// SPDX-FileCopyrightText: 2022 Marshall Wace <opensource@mwam.com>
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+// cacheError is a classified failure to get a blob, carrying the HTTP status and S3 error code
+// to respond with. Its message is what peers send back over /_groupcache, so it can be
+// parsed back into the same error on the requesting node
+type cacheError struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *cacheError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+var (
+	errNotFound        = &cacheError{404, "NoSuchKey", "The specified key does not exist."}
+	errNoSuchBucket    = &cacheError{404, "NoSuchBucket", "The specified bucket does not exist."}
+	errAccessDenied    = &cacheError{403, "AccessDenied", "Access Denied"}
+	errSlowDown        = &cacheError{503, "SlowDown", "Please reduce your request rate."}
+	errS3Unavailable   = &cacheError{503, "ServiceUnavailable", "S3 is unreachable, please try again."}
+	errPeerUnavailable = &cacheError{503, "ServiceUnavailable", "Cache peer is unreachable, please try again."}
+	errGetTimeout      = &cacheError{504, "RequestTimeout", "Timed out getting blob."}
+
+	knownCacheErrors = []*cacheError{
+		errNotFound, errNoSuchBucket, errAccessDenied, errSlowDown, errS3Unavailable, errPeerUnavailable, errGetTimeout,
+	}
+	throttlingErrorCodes = []string{
+		"SlowDown", "Throttling", "ThrottlingException", "RequestLimitExceeded", "TooManyRequests",
+	}
+	unavailableErrorCodes = []string{
+		request.ErrCodeRequestError, request.ErrCodeResponseTimeout, "ServiceUnavailable", "InternalError",
+	}
+)
+
+// classifyError maps S3, context and peer errors to the response they should produce
+func classifyError(err error) *cacheError {
+	var cerr *cacheError
+	if errors.As(err, &cerr) {
+		return cerr
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return errGetTimeout
+	}
+
+	if reqErr, ok := err.(awserr.RequestFailure); ok {
+		switch {
+		case reqErr.Code() == "NoSuchBucket":
+			return errNoSuchBucket
+		case reqErr.StatusCode() == 404:
+			return errNotFound
+		case reqErr.StatusCode() == 403:
+			return errAccessDenied
+		case reqErr.StatusCode() == 429 || containsString(throttlingErrorCodes, reqErr.Code()):
+			return errSlowDown
+		case reqErr.StatusCode() == 503 || reqErr.StatusCode() == 500:
+			return errS3Unavailable
+		}
+	}
+	if awsErr, ok := err.(awserr.Error); ok {
+		switch {
+		case awsErr.Code() == request.CanceledErrorCode:
+			return errGetTimeout
+		case containsString(throttlingErrorCodes, awsErr.Code()):
+			return errSlowDown
+		case containsString(unavailableErrorCodes, awsErr.Code()):
+			return errS3Unavailable
+		}
+	}
+
+	return &cacheError{500, "InternalError", err.Error()}
+}
+
+// isNotFoundErr reports whether the error means the key doesn't exist in S3
+func isNotFoundErr(err error) bool {
+	return classifyError(err) == errNotFound
+}
+
+// renderCacheError responds with the status and S3 error code matching why a blob couldn't be got
+func renderCacheError(c *gin.Context, cacheKey string, err error, renderError errorRenderer) {
+	cerr := classifyError(err)
+	if cerr.Status >= 500 {
+		log.Errorf("Failed to get '%s': %v", cacheKey, err)
+	}
+	renderError(c, cerr.Status, cerr.Code, fmt.Sprintf("Failed to get blob '%s': %s", cacheKey, cerr.Message))
+}
+
+func parseCacheError(message string) (*cacheError, bool) {
+	for _, cerr := range knownCacheErrors {
+		if message == cerr.Error() {
+			return cerr, true
+		}
+	}
+	return nil, false
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+type peerErrorKey struct{}
+
+// peerErrorSlot holds the error a peer returned for a key, so the local fallback groupcache
+// runs after a failed peer load can return it instead of asking S3 again
+type peerErrorSlot struct {
+	mu  sync.Mutex
+	err *cacheError
+}
+
+func withPeerErrorSlot(ctx context.Context) context.Context {
+	return context.WithValue(ctx, peerErrorKey{}, &peerErrorSlot{})
+}
+
+// peerError returns the classified error a peer answered with for this request, if any
+func peerError(ctx context.Context) error {
+	slot, ok := ctx.Value(peerErrorKey{}).(*peerErrorSlot)
+	if !ok {
+		return nil
+	}
+	slot.mu.Lock()
+	defer slot.mu.Unlock()
+	if slot.err == nil {
+		return nil
+	}
+	return slot.err
+}
+
+// peerTransport turns peer error responses back into the typed errors the owner's filler returned,
+// and fails requests to peers with an open circuit straight away
+type peerTransport struct {
+	ctx  context.Context
+	base http.RoundTripper
+}
+
+func newPeerTransport(ctx context.Context) http.RoundTripper {
+	return &peerTransport{ctx: ctx, base: peerHTTPTransport}
+}
+
+func (t *peerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	peer := req.URL.Scheme + "://" + req.URL.Host
+	if !peerAllowed(peer) {
+		return nil, errPeerUnavailable
+	}
+	res, err := t.base.RoundTrip(req)
+	if err != nil {
+		peerFailed(peer)
+		if errors.Is(err, context.DeadlineExceeded) {
+			return nil, errGetTimeout
+		}
+		log.Debugf("Peer '%s' unreachable: %v", req.URL.Host, err)
+		return nil, errPeerUnavailable
+	}
+	peerSucceeded(peer)
+	if req.Method != http.MethodGet || res.StatusCode == http.StatusOK {
+		return res, nil
+	}
+
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return nil, errPeerUnavailable
+	}
+	cerr, ok := parseCacheError(strings.TrimSpace(string(body)))
+	if !ok {
+		res.Body = ioutil.NopCloser(bytes.NewReader(body))
+		return res, nil
+	}
+	if slot, ok := t.ctx.Value(peerErrorKey{}).(*peerErrorSlot); ok {
+		slot.mu.Lock()
+		slot.err = cerr
+		slot.mu.Unlock()
+	}
+	return nil, cerr
+}
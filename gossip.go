@@ -0,0 +1,189 @@
+// SPDX-FileCopyrightText: 2022 Marshall Wace <opensource@mwam.com>
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	gossipFanout = 3
+	// Contact a seed every this many rounds even when members are known, to heal partitions
+	gossipSeedRounds = 10
+	// Dead members are remembered for this many suspicion timeouts, so stale gossip about
+	// them doesn't bring them back
+	gossipForgetFactor = 10
+)
+
+var (
+	gossipSeedsFlag        string
+	gossipSeeds            []string
+	gossipInterval         int
+	gossipSuspicionTimeout int
+
+	members   = map[string]*member{}
+	membersMu sync.Mutex
+)
+
+// member is a node known through gossip. Its heartbeat only ever increases while it's alive
+// (it's the node's clock in nanoseconds), so a member is alive while we keep hearing newer ones
+type member struct {
+	heartbeat int64
+	updated   time.Time
+}
+
+type gossipMessage struct {
+	From    string           `json:"from"`
+	Members map[string]int64 `json:"members"`
+}
+
+// runGossip exchanges membership with a few random members (or seeds) every interval,
+// feeding the members heard from within the suspicion timeout into the peers list
+func runGossip() {
+	for round := 0; ; round++ {
+		targets := gossipTargets(round%gossipSeedRounds == 0)
+		wg := sync.WaitGroup{}
+		for _, target := range targets {
+			wg.Add(1)
+			go func(target string) {
+				defer wg.Done()
+				if err := gossipWith(target); err != nil {
+					log.Debugf("Failed to gossip with '%s': %v", target, err)
+				}
+			}(target)
+		}
+		wg.Wait()
+
+		setPeers(liveMembers())
+		time.Sleep(time.Second * time.Duration(gossipInterval))
+	}
+}
+
+// gossipTargets picks up to gossipFanout random live members, plus a random seed if none are
+// known yet or withSeed is set
+func gossipTargets(withSeed bool) []string {
+	targets := []string{}
+	for _, peer := range liveMembers() {
+		if peer != selfPeer {
+			targets = append(targets, peer)
+		}
+	}
+	rand.Shuffle(len(targets), func(i, j int) { targets[i], targets[j] = targets[j], targets[i] })
+	if len(targets) > gossipFanout {
+		targets = targets[:gossipFanout]
+	}
+
+	if len(targets) == 0 || withSeed {
+		seeds := []string{}
+		for _, seed := range gossipSeeds {
+			if seed != selfPeer && !containsString(targets, seed) {
+				seeds = append(seeds, seed)
+			}
+		}
+		if len(seeds) > 0 {
+			targets = append(targets, seeds[rand.Intn(len(seeds))])
+		}
+	}
+	return targets
+}
+
+// gossipWith sends our membership view to a peer and merges the view it answers with
+func gossipWith(peer string) error {
+	body, err := json.Marshal(gossipMessage{From: selfPeer, Members: membershipView()})
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*time.Duration(gossipInterval))
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, peer+"/_groupcache/gossip", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := peerClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("peer returned %d", res.StatusCode)
+	}
+	msg := gossipMessage{}
+	if err := json.NewDecoder(res.Body).Decode(&msg); err != nil {
+		return err
+	}
+	mergeMembership(msg.Members)
+	return nil
+}
+
+// serveGossip merges a peer's membership view, answering with ours
+func serveGossip(c *gin.Context) {
+	msg := gossipMessage{}
+	if err := c.ShouldBindJSON(&msg); err != nil {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("Invalid gossip message: %v", err)})
+		return
+	}
+	mergeMembership(msg.Members)
+	c.JSON(200, gossipMessage{From: selfPeer, Members: membershipView()})
+}
+
+// membershipView bumps our own heartbeat and returns the heartbeats of live members
+func membershipView() map[string]int64 {
+	membersMu.Lock()
+	defer membersMu.Unlock()
+
+	members[selfPeer] = &member{heartbeat: time.Now().UnixNano(), updated: time.Now()}
+	view := map[string]int64{}
+	for peer, m := range members {
+		if time.Since(m.updated) <= time.Second*time.Duration(gossipSuspicionTimeout) {
+			view[peer] = m.heartbeat
+		}
+	}
+	return view
+}
+
+// mergeMembership takes the newer heartbeats from a peer's view, forgetting long dead members
+func mergeMembership(view map[string]int64) {
+	membersMu.Lock()
+	defer membersMu.Unlock()
+
+	for peer, heartbeat := range view {
+		if peer == selfPeer {
+			continue
+		}
+		if m, ok := members[peer]; !ok || heartbeat > m.heartbeat {
+			members[peer] = &member{heartbeat: heartbeat, updated: time.Now()}
+		}
+	}
+	for peer, m := range members {
+		if time.Since(m.updated) > time.Second*time.Duration(gossipSuspicionTimeout*gossipForgetFactor) {
+			delete(members, peer)
+		}
+	}
+}
+
+// liveMembers returns the members heard from within the suspicion timeout, including self
+func liveMembers() []string {
+	membersMu.Lock()
+	defer membersMu.Unlock()
+
+	live := []string{selfPeer}
+	for peer, m := range members {
+		if peer != selfPeer && time.Since(m.updated) <= time.Second*time.Duration(gossipSuspicionTimeout) {
+			live = append(live, peer)
+		}
+	}
+	return live
+}
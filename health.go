@@ -0,0 +1,128 @@
+// SPDX-FileCopyrightText: 2022 Marshall Wace <opensource@mwam.com>
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Longest a peer's circuit stays open before it's retried, however often retries failed
+const maxPeerRetryBackoff = 5 * time.Minute
+
+var (
+	peerFailureThreshold int
+	peerRetryBackoff     int
+
+	peerCircuits   = map[string]*peerCircuit{}
+	peerCircuitsMu sync.Mutex
+)
+
+// peerCircuit is a circuit breaker for a peer. After -peer-failure-threshold consecutive failed
+// requests it opens, failing requests to the peer straight away so keys it owns are loaded from
+// S3 locally. Once the backoff has passed, one request is let through to probe it: success
+// closes the circuit, failure opens it again for twice as long
+type peerCircuit struct {
+	failures  int
+	opens     int
+	openUntil time.Time
+	probing   bool
+}
+
+// peerAllowed reports whether a request can be sent to a peer, false while its circuit is open
+func peerAllowed(peer string) bool {
+	peerCircuitsMu.Lock()
+	defer peerCircuitsMu.Unlock()
+
+	circuit, ok := peerCircuits[peer]
+	if !ok || circuit.opens == 0 {
+		return true
+	}
+	if circuit.probing || time.Now().Before(circuit.openUntil) {
+		return false
+	}
+	log.Debugf("Probing unhealthy peer '%s'", peer)
+	circuit.probing = true
+	return true
+}
+
+// peerSucceeded closes a peer's circuit
+func peerSucceeded(peer string) {
+	peerCircuitsMu.Lock()
+	defer peerCircuitsMu.Unlock()
+
+	circuit, ok := peerCircuits[peer]
+	if !ok {
+		return
+	}
+	if circuit.opens > 0 {
+		log.Infof("Peer '%s' is healthy again", peer)
+		peerCircuitOpenMetric.WithLabelValues(peer).Set(0)
+	}
+	delete(peerCircuits, peer)
+}
+
+// peerFailed counts a failed request to a peer, opening its circuit past the threshold or if
+// it was being probed
+func peerFailed(peer string) {
+	peerCircuitsMu.Lock()
+	defer peerCircuitsMu.Unlock()
+
+	circuit, ok := peerCircuits[peer]
+	if !ok {
+		circuit = &peerCircuit{}
+		peerCircuits[peer] = circuit
+	}
+	circuit.failures++
+	if !circuit.probing && (circuit.opens > 0 || circuit.failures < peerFailureThreshold) {
+		return
+	}
+
+	backoff := time.Second * time.Duration(peerRetryBackoff)
+	for i := 0; i < circuit.opens && backoff < maxPeerRetryBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxPeerRetryBackoff {
+		backoff = maxPeerRetryBackoff
+	}
+	if circuit.opens == 0 {
+		log.Warnf("Peer '%s' is unhealthy after %d failed requests, loading its keys from S3 for %s",
+			peer, circuit.failures, backoff)
+		peerCircuitOpenMetric.WithLabelValues(peer).Set(1)
+	} else {
+		log.Debugf("Peer '%s' still unhealthy, retrying in %s", peer, backoff)
+	}
+	circuit.opens++
+	circuit.probing = false
+	circuit.openUntil = time.Now().Add(backoff)
+}
+
+// forgetPeerCircuits drops the circuits of peers that left the cluster, and their metric
+func forgetPeerCircuits(left []string) {
+	peerCircuitsMu.Lock()
+	defer peerCircuitsMu.Unlock()
+
+	for _, peer := range left {
+		delete(peerCircuits, peer)
+		peerCircuitOpenMetric.DeleteLabelValues(peer)
+	}
+}
+
+// unhealthyPeers returns the peers whose circuit is open
+func unhealthyPeers() []string {
+	peerCircuitsMu.Lock()
+	defer peerCircuitsMu.Unlock()
+
+	unhealthy := []string{}
+	for peer, circuit := range peerCircuits {
+		if circuit.opens > 0 {
+			unhealthy = append(unhealthy, peer)
+		}
+	}
+	sort.Strings(unhealthy)
+	return unhealthy
+}
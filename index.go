@@ -0,0 +1,150 @@
+// SPDX-FileCopyrightText: 2022 Marshall Wace <opensource@mwam.com>
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/mailgun/groupcache/v2"
+)
+
+// Max number of keys tracked in the local cache index, oldest are dropped first
+const maxIndexEntries = 100000
+
+// cacheIndex tracks the metadata of blobs loaded into this node's cache. groupcache
+// doesn't expose its keys, so this is how a node knows what it holds. It isn't told about
+// groupcache's own evictions, so it can list keys that are no longer cached.
+type cacheIndex struct {
+	mu      sync.Mutex
+	ll      *list.List
+	entries map[string]*list.Element
+	// Whether keys were dropped for maxIndexEntries, so some cached keys may be missing
+	overflowed bool
+}
+
+type indexEntry struct {
+	cacheKey string
+	meta     objectMetadata
+	// Bytes held in cache for the key
+	size   int64
+	expire time.Time
+	hits   int64
+}
+
+var (
+	localIndex = newCacheIndex()
+	// Metadata cached from HEAD requests, for keys whose blob may not be cached here
+	metadataIndex = newCacheIndex()
+)
+
+func newCacheIndex() *cacheIndex {
+	return &cacheIndex{
+		ll:      list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+func (idx *cacheIndex) add(cacheKey string, meta objectMetadata, size int64, expire time.Time) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if el, ok := idx.entries[cacheKey]; ok {
+		idx.ll.MoveToFront(el)
+		entry := el.Value.(*indexEntry)
+		entry.meta = meta
+		entry.size = size
+		entry.expire = expire
+		return
+	}
+
+	idx.entries[cacheKey] = idx.ll.PushFront(&indexEntry{cacheKey: cacheKey, meta: meta, size: size, expire: expire})
+	if idx.ll.Len() > maxIndexEntries {
+		idx.removeElement(idx.ll.Back())
+		idx.overflowed = true
+	}
+}
+
+func (idx *cacheIndex) get(cacheKey string) (indexEntry, bool) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	el, ok := idx.entries[cacheKey]
+	if !ok {
+		return indexEntry{}, false
+	}
+	entry := el.Value.(*indexEntry)
+	if time.Now().After(entry.expire) {
+		idx.removeElement(el)
+		return indexEntry{}, false
+	}
+	idx.ll.MoveToFront(el)
+	return *entry, true
+}
+
+// hit counts a get of a key, if it's in the index
+func (idx *cacheIndex) hit(cacheKey string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if el, ok := idx.entries[cacheKey]; ok {
+		idx.ll.MoveToFront(el)
+		el.Value.(*indexEntry).hits++
+	}
+}
+
+// snapshot returns the unexpired entries, most recently used first
+func (idx *cacheIndex) snapshot() []indexEntry {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	now := time.Now()
+	entries := make([]indexEntry, 0, idx.ll.Len())
+	for el := idx.ll.Front(); el != nil; el = el.Next() {
+		if entry := el.Value.(*indexEntry); now.Before(entry.expire) {
+			entries = append(entries, *entry)
+		}
+	}
+	return entries
+}
+
+// cached returns the unexpired entries like snapshot, leaving out the least recently used ones
+// beyond the number of items groupcache holds, as those are the ones it would have evicted
+func (idx *cacheIndex) cached(group *resettableGroup) []indexEntry {
+	entries := idx.snapshot()
+	if items := group.CacheStats(groupcache.MainCache).Items; int64(len(entries)) > items {
+		entries = entries[:items]
+	}
+	return entries
+}
+
+// complete reports whether every key loaded since the last reset is still in the index
+func (idx *cacheIndex) complete() bool {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	return !idx.overflowed
+}
+
+func (idx *cacheIndex) reset() {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.ll.Init()
+	idx.entries = make(map[string]*list.Element)
+	idx.overflowed = false
+}
+
+func (idx *cacheIndex) remove(cacheKey string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if el, ok := idx.entries[cacheKey]; ok {
+		idx.removeElement(el)
+	}
+}
+
+func (idx *cacheIndex) removeElement(el *list.Element) {
+	idx.ll.Remove(el)
+	delete(idx.entries, el.Value.(*indexEntry).cacheKey)
+}
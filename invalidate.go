@@ -0,0 +1,162 @@
+// SPDX-FileCopyrightText: 2022 Marshall Wace <opensource@mwam.com>
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/adrianchifor/go-parallel"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+// restCacheInvalidatePrefix drops every cached key matching the bucket and prefix globs from the
+// whole cluster. groupcache can't enumerate keys, so each node removes the keys it knows it
+// holds (from its index and disk cache), with the removals also clearing peers' hot caches.
+// If any node's index was full and lost track of some keys, every node drops its whole memory cache
+func restCacheInvalidatePrefix(c *gin.Context, bucket string, prefix string) {
+	log.Debugf("Invalidating '%s#%s' from cache across the cluster", bucket, prefix)
+	localInvalidated, localErr := invalidateLocalMatches(bucket, prefix)
+	invalidated := int64(localInvalidated)
+	overflowed := int32(0)
+	if !localIndex.complete() || !metadataIndex.complete() {
+		overflowed = 1
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), time.Millisecond*time.Duration(timeout))
+	defer cancel()
+	query := url.Values{"bucket": {bucket}, "prefix": {prefix}}.Encode()
+	errs := fanOut(func(peerURL string) error {
+		res := struct {
+			Invalidated int  `json:"invalidated"`
+			Overflowed  bool `json:"overflowed"`
+		}{}
+		if err := peerJSON(ctx, http.MethodPost, peerURL+"invalidate?"+query, nil, &res); err != nil {
+			return err
+		}
+		atomic.AddInt64(&invalidated, int64(res.Invalidated))
+		if res.Overflowed {
+			atomic.StoreInt32(&overflowed, 1)
+		}
+		return nil
+	})
+
+	if localErr != nil {
+		errs[selfPeer+"/_groupcache/"] = localErr
+	}
+
+	full := overflowed == 1
+	if full {
+		log.Warnf("Key index of some nodes is full, dropping every key from memory to invalidate '%s#%s'", bucket, prefix)
+		resetCache()
+		for peerURL, err := range fanOut(func(peerURL string) error {
+			return peerJSON(ctx, http.MethodPost, peerURL+"invalidate?full=true", nil, nil)
+		}) {
+			errs[peerURL] = err
+		}
+	}
+
+	if len(errs) > 0 {
+		msg := fmt.Sprintf("Failed to invalidate '%s#%s' on peer(s): %s", bucket, prefix, fanOutError(errs))
+		log.Errorf(msg)
+		c.JSON(500, gin.H{"error": msg, "invalidated": invalidated, "full": full})
+		return
+	}
+	c.JSON(200, gin.H{
+		"message":     fmt.Sprintf("%d key(s) matching '%s#%s' invalidated from cache", invalidated, bucket, prefix),
+		"invalidated": invalidated,
+		"full":        full,
+		"error":       "",
+	})
+}
+
+// serveInvalidate handles the local part of a cluster-wide prefix invalidation for a peer,
+// reporting if its index is full, or drops its whole memory cache when full is set
+func serveInvalidate(c *gin.Context) {
+	if c.Query("full") == "true" {
+		resetCache()
+		c.JSON(200, gin.H{"invalidated": 0})
+		return
+	}
+
+	bucket := strings.TrimSpace(c.Query("bucket"))
+	prefix := strings.TrimSpace(c.Query("prefix"))
+	if bucket == "" || prefix == "" {
+		c.JSON(400, gin.H{"error": "'bucket' and 'prefix' are required"})
+		return
+	}
+	invalidated, err := invalidateLocalMatches(bucket, prefix)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error(), "invalidated": invalidated})
+		return
+	}
+	c.JSON(200, gin.H{
+		"invalidated": invalidated,
+		"overflowed":  !localIndex.complete() || !metadataIndex.complete(),
+	})
+}
+
+// invalidateLocalMatches removes the keys this node holds matching the bucket and prefix globs,
+// returning the first error of keys that couldn't be removed from every peer
+func invalidateLocalMatches(bucketGlob string, prefixGlob string) (int, error) {
+	cacheKeys := matchingCachedKeys(bucketGlob, prefixGlob)
+
+	mu := sync.Mutex{}
+	var firstErr error
+	removePool := parallel.SmallJobPool()
+	defer removePool.Close()
+	for _, cacheKey := range cacheKeys {
+		cacheKey := cacheKey
+		removePool.AddJob(func() {
+			if err := removeCacheKey(cacheKey); err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+			}
+		})
+	}
+	removePool.Wait()
+
+	log.Debugf("Invalidated %d local key(s) matching '%s#%s'", len(cacheKeys), bucketGlob, prefixGlob)
+	return len(cacheKeys), firstErr
+}
+
+// matchingCachedKeys lists the blob, block and metadata keys this node holds matching the
+// bucket and prefix globs, the same syntax as TTL rules
+func matchingCachedKeys(bucketGlob string, prefixGlob string) []string {
+	bucketRegexp := globToRegexp(bucketGlob, true)
+	prefixRegexp := globToRegexp(prefixGlob, false)
+
+	seen := map[string]bool{}
+	cacheKeys := []string{}
+	match := func(cacheKey string) {
+		bucket, key, _, _ := parseCacheKey(cacheKey)
+		if !seen[cacheKey] && bucketRegexp.MatchString(bucket) && prefixRegexp.MatchString(key) {
+			seen[cacheKey] = true
+			cacheKeys = append(cacheKeys, cacheKey)
+		}
+	}
+
+	for _, entry := range localIndex.snapshot() {
+		match(entry.cacheKey)
+	}
+	for _, entry := range metadataIndex.snapshot() {
+		match(entry.cacheKey)
+	}
+	if diskCache != nil {
+		for _, cacheKey := range diskCache.keys() {
+			match(cacheKey)
+		}
+	}
+	return cacheKeys
+}
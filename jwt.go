@@ -25,6 +25,9 @@ type JwtClaims struct {
 	jwt.StandardClaims
 }
 
+// Gin context key of the claims a request's JWT was validated with
+const jwtClaimsContextKey = "jwtClaims"
+
 type AuthHeader struct {
 	Authorization string `header:"Authorization"`
 }
@@ -44,6 +47,10 @@ func jwtMiddleware() gin.HandlerFunc {
 		if strings.HasPrefix(c.Request.RequestURI, "/healthz") {
 			return
 		}
+		// Peers authenticate with peerAuthMiddleware instead, they have no client JWT
+		if peerAuthEnabled() && strings.HasPrefix(c.Request.URL.Path, "/_groupcache/") {
+			return
+		}
 
 		h := AuthHeader{}
 		if err := c.ShouldBindHeader(&h); err != nil || h.Authorization == "" {
@@ -107,6 +114,19 @@ func jwtMiddleware() gin.HandlerFunc {
 				return
 			}
 
+			if isAdminRequest(c.Request.URL.Path) {
+				if claims.Action != "ADMIN" {
+					log.Debugf("Got valid JWT token, but action %s isn't ADMIN for admin request", claims.Action)
+					jwtRequestsMetric.WithLabelValues("false", "JWT action is not ADMIN").Inc()
+					c.JSON(401, gin.H{"error": "JWT token action allow doesn't include admin requests"})
+					c.Abort()
+					return
+				}
+				log.Debugf("Got valid admin JWT token, exiting JWT middleware")
+				jwtRequestsMetric.WithLabelValues("true", "").Inc()
+				return
+			}
+
 			if !validActionForHttpMethod(claims.Action, c.Request.Method) {
 				log.Debugf("Got valid JWT token, but action allow doesn't match request (action %s != method %s)", claims.Action, c.Request.Method)
 				jwtRequestsMetric.WithLabelValues("false", "JWT action does not match method").Inc()
@@ -126,6 +146,18 @@ func jwtMiddleware() gin.HandlerFunc {
 				keyParam = getRequestParam(c, "path")
 			}
 
+			// Endpoints taking globs match every bucket and key by default, so scoped tokens have
+			// to name theirs, and can't have globs match past their scope
+			if acceptsGlobs(c.Request.URL.Path) && getRequestParam(c, "key") == "" {
+				if msg := globScopeError(claims, bucketParam, getRequestParam(c, "prefix")); msg != "" {
+					log.Debugf("JWT token scope doesn't cover request globs: %s", msg)
+					jwtRequestsMetric.WithLabelValues("false", "JWT token scope does not cover globs").Inc()
+					c.JSON(401, gin.H{"error": msg})
+					c.Abort()
+					return
+				}
+			}
+
 			// Compare request bucket and key params with JWT bucket and key params
 			if keyParam != "" && strings.TrimSpace(claims.Prefix) != "" && !strings.HasPrefix(keyParam, strings.TrimSpace(claims.Prefix)) {
 				log.Debugf("JWT token prefix does not match URL object (prefix %s != object %s)", claims.Prefix, strings.TrimSpace(keyParam))
@@ -145,6 +177,7 @@ func jwtMiddleware() gin.HandlerFunc {
 
 			log.Debugf("Got valid JWT token, exiting JWT middleware")
 			jwtRequestsMetric.WithLabelValues("true", "").Inc()
+			c.Set(jwtClaimsContextKey, claims)
 		} else {
 			jwtRequestsMetric.WithLabelValues("false", "JWT claims invalid").Inc()
 			c.JSON(401, gin.H{"error": "JWT token invalid"})
@@ -153,6 +186,50 @@ func jwtMiddleware() gin.HandlerFunc {
 	}
 }
 
+// acceptsGlobs reports whether an endpoint's bucket and prefix params are globs
+func acceptsGlobs(path string) bool {
+	switch path {
+	case "/invalidate", "/cache/keys", "/cache/owner", "/_groupcache/invalidate", "/_groupcache/keys":
+		return true
+	}
+	return false
+}
+
+func globScopeError(claims *JwtClaims, bucketGlob string, prefixGlob string) string {
+	bucket := strings.TrimSpace(claims.Bucket)
+	prefix := strings.TrimSpace(claims.Prefix)
+	if bucket != "" && bucketGlob == "" {
+		return "JWT token is scoped to a bucket, 'bucket' is required"
+	}
+	if prefix != "" && prefixGlob == "" {
+		return "JWT token is scoped to a prefix, 'prefix' is required"
+	}
+	if prefix != "" && strings.ContainsAny(prefix, "*?") {
+		return "JWT token prefix contains glob characters, 'prefix' globs can't match it exactly"
+	}
+	return ""
+}
+
+// requestClaims returns the JWT claims a request was authorized with, nil without JWT auth
+func requestClaims(c *gin.Context) *JwtClaims {
+	if claims, ok := c.Get(jwtClaimsContextKey); ok {
+		return claims.(*JwtClaims)
+	}
+	return nil
+}
+
+// keyScopeError checks a bucket and key against a JWT token's bucket and prefix, for keys
+// given in request bodies rather than params
+func keyScopeError(claims *JwtClaims, bucket string, key string) string {
+	if prefix := strings.TrimSpace(claims.Prefix); prefix != "" && !strings.HasPrefix(key, prefix) {
+		return "JWT token prefix does not match object '" + key + "'"
+	}
+	if claimBucket := strings.TrimSpace(claims.Bucket); claimBucket != "" && claimBucket != bucket {
+		return "JWT token bucket does not match bucket '" + bucket + "'"
+	}
+	return ""
+}
+
 func validActionForHttpMethod(action string, method string) bool {
 	switch action {
 	case "READ":
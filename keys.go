@@ -0,0 +1,257 @@
+// SPDX-FileCopyrightText: 2022 Marshall Wace <opensource@mwam.com>
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultKeysLimit = 1000
+
+// cachedKey describes a blob or block held by a node, as tracked by its local index
+type cachedKey struct {
+	Key        string    `json:"key"`
+	Bucket     string    `json:"bucket"`
+	Object     string    `json:"object"`
+	Block      *int64    `json:"block,omitempty"`
+	Size       int64     `json:"size"`
+	ObjectSize int64     `json:"objectSize"`
+	ETag       string    `json:"etag,omitempty"`
+	Expire     time.Time `json:"expire"`
+	Stale      bool      `json:"stale"`
+	Hits       int64     `json:"hits"`
+	OnDisk     bool      `json:"onDisk"`
+	Owner      string    `json:"owner"`
+	Node       string    `json:"node"`
+}
+
+type cachedKeysResponse struct {
+	Keys      []cachedKey `json:"keys"`
+	Count     int         `json:"count"`
+	Truncated bool        `json:"truncated"`
+	Error     string      `json:"error"`
+}
+
+// restCacheKeys lists the keys cached on this node, or on every node with cluster=true,
+// optionally filtered by bucket and prefix globs and sorted by key or hits
+func restCacheKeys(c *gin.Context) {
+	bucket := strings.TrimSpace(c.DefaultQuery("bucket", "*"))
+	prefix := strings.TrimSpace(c.Query("prefix"))
+	sortBy := c.DefaultQuery("sort", "key")
+	if sortBy != "key" && sortBy != "hits" {
+		c.JSON(400, gin.H{"error": "'sort' must be 'key' or 'hits'"})
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultKeysLimit)))
+	if err != nil || limit <= 0 {
+		c.JSON(400, gin.H{"error": "'limit' must be a positive integer"})
+		return
+	}
+
+	if c.Query("cluster") != "true" {
+		keys, truncated := localCachedKeys(bucket, prefix, sortBy, limit)
+		c.JSON(200, cachedKeysResponse{Keys: keys, Count: len(keys), Truncated: truncated})
+		return
+	}
+
+	res, errs := clusterCachedKeys(c.Request.Context(), bucket, prefix, sortBy, limit)
+	if len(errs) > 0 {
+		res.Error = fmt.Sprintf("Failed to list keys on peer(s): %s", fanOutError(errs))
+		log.Errorf(res.Error)
+		c.JSON(500, res)
+		return
+	}
+	c.JSON(200, res)
+}
+
+// serveKeys lists this node's cached keys for a peer aggregating them
+func serveKeys(c *gin.Context) {
+	limit, err := strconv.Atoi(c.Query("limit"))
+	if err != nil || limit <= 0 {
+		limit = defaultKeysLimit
+	}
+	keys, truncated := localCachedKeys(c.DefaultQuery("bucket", "*"), c.Query("prefix"), c.DefaultQuery("sort", "key"), limit)
+	c.JSON(200, cachedKeysResponse{Keys: keys, Count: len(keys), Truncated: truncated})
+}
+
+// clusterCachedKeys merges the keys cached on every node, returning errors by peer URL for
+// the nodes that couldn't be listed
+func clusterCachedKeys(ctx context.Context, bucketGlob string, prefixGlob string, sortBy string, limit int) (cachedKeysResponse, map[string]error) {
+	keys, truncated := localCachedKeys(bucketGlob, prefixGlob, sortBy, limit)
+
+	ctx, cancel := context.WithTimeout(ctx, time.Millisecond*time.Duration(timeout))
+	defer cancel()
+	mu := sync.Mutex{}
+	query := url.Values{
+		"bucket": {bucketGlob},
+		"prefix": {prefixGlob},
+		"sort":   {sortBy},
+		"limit":  {strconv.Itoa(limit)},
+	}.Encode()
+	errs := fanOut(func(peerURL string) error {
+		res := cachedKeysResponse{}
+		if err := peerJSON(ctx, http.MethodGet, peerURL+"keys?"+query, nil, &res); err != nil {
+			return err
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		keys = append(keys, res.Keys...)
+		truncated = truncated || res.Truncated
+		return nil
+	})
+
+	sortCachedKeys(keys, sortBy)
+	if len(keys) > limit {
+		keys, truncated = keys[:limit], true
+	}
+	return cachedKeysResponse{Keys: keys, Count: len(keys), Truncated: truncated}, errs
+}
+
+// sortCachedKeys orders keys by key then node, or by most hits first
+func sortCachedKeys(keys []cachedKey, sortBy string) {
+	sort.SliceStable(keys, func(i, j int) bool {
+		if sortBy == "hits" && keys[i].Hits != keys[j].Hits {
+			return keys[i].Hits > keys[j].Hits
+		}
+		if keys[i].Key != keys[j].Key {
+			return keys[i].Key < keys[j].Key
+		}
+		return keys[i].Node < keys[j].Node
+	})
+}
+
+// localCachedKeys returns up to limit indexed keys matching the bucket and prefix globs
+func localCachedKeys(bucketGlob string, prefixGlob string, sortBy string, limit int) ([]cachedKey, bool) {
+	bucketRegexp := globToRegexp(bucketGlob, true)
+	prefixRegexp := globToRegexp(prefixGlob, false)
+
+	keys := []cachedKey{}
+	now := time.Now()
+	for _, entry := range localIndex.cached(cacheGroup) {
+		bucket, key, block, isBlock := parseCacheKey(entry.cacheKey)
+		if entry.meta.NotFound || !bucketRegexp.MatchString(bucket) || !prefixRegexp.MatchString(key) {
+			continue
+		}
+
+		k := cachedKey{
+			Key:        entry.cacheKey,
+			Bucket:     bucket,
+			Object:     key,
+			Size:       entry.size,
+			ObjectSize: entry.meta.ContentLength,
+			ETag:       entry.meta.ETag,
+			Expire:     entry.expire,
+			Stale:      !entry.meta.FreshUntil.IsZero() && now.After(entry.meta.FreshUntil),
+			Hits:       entry.hits,
+			OnDisk:     diskCache != nil && diskCache.contains(entry.cacheKey),
+			Owner:      ownerOf(entry.cacheKey),
+			Node:       selfPeer,
+		}
+		if isBlock {
+			k.Block = &block
+		}
+		keys = append(keys, k)
+	}
+
+	sortCachedKeys(keys, sortBy)
+	if len(keys) > limit {
+		return keys[:limit], true
+	}
+	return keys, false
+}
+
+type keyOwner struct {
+	Key   string `json:"key"`
+	Owner string `json:"owner"`
+	Self  bool   `json:"self"`
+	// Replicas also serving the key, with -replication-factor above 1
+	Replicas []string `json:"replicas,omitempty"`
+	Hits     int64    `json:"hits,omitempty"`
+}
+
+// restCacheOwner returns the peer owning a key in the consistent hash ring, or with top=N the
+// owners of the N most hit keys across the cluster
+func restCacheOwner(c *gin.Context) {
+	if top := c.Query("top"); top != "" {
+		n, err := strconv.Atoi(top)
+		if err != nil || n <= 0 {
+			c.JSON(400, gin.H{"error": "'top' must be a positive integer"})
+			return
+		}
+		restTopKeysOwners(c, n)
+		return
+	}
+
+	bucket := strings.TrimSpace(c.Query("bucket"))
+	if bucket == "" {
+		c.JSON(400, gin.H{"error": "'bucket' not found in querystring parameters"})
+		return
+	}
+	key := strings.TrimSpace(c.Query("key"))
+	if key == "" {
+		c.JSON(400, gin.H{"error": "'key' not found in querystring parameters"})
+		return
+	}
+
+	cacheKey := constructCacheKey(bucket, key)
+	if block := c.Query("block"); block != "" {
+		n, err := strconv.ParseInt(block, 10, 64)
+		if err != nil || n < 0 {
+			c.JSON(400, gin.H{"error": "'block' must be a non-negative integer"})
+			return
+		}
+		cacheKey = constructBlockKey(bucket, key, n)
+	}
+
+	owner := ownerOf(cacheKey)
+	c.JSON(200, keyOwner{Key: cacheKey, Owner: owner, Self: owner == selfPeer, Replicas: keyOwners(cacheKey)[1:]})
+}
+
+// restTopKeysOwners sums the hits of cached keys across the cluster and returns the owners of
+// the n most hit. Each node only reports its own n most hit keys, so counts are a lower bound
+func restTopKeysOwners(c *gin.Context, n int) {
+	bucket := strings.TrimSpace(c.DefaultQuery("bucket", "*"))
+	prefix := strings.TrimSpace(c.Query("prefix"))
+	res, errs := clusterCachedKeys(c.Request.Context(), bucket, prefix, "hits", n)
+
+	hits := map[string]int64{}
+	for _, k := range res.Keys {
+		hits[k.Key] += k.Hits
+	}
+	owners := []keyOwner{}
+	for cacheKey, h := range hits {
+		owner := ownerOf(cacheKey)
+		owners = append(owners, keyOwner{
+			Key: cacheKey, Owner: owner, Self: owner == selfPeer, Hits: h, Replicas: keyOwners(cacheKey)[1:],
+		})
+	}
+	sort.Slice(owners, func(i, j int) bool {
+		if owners[i].Hits != owners[j].Hits {
+			return owners[i].Hits > owners[j].Hits
+		}
+		return owners[i].Key < owners[j].Key
+	})
+	if len(owners) > n {
+		owners = owners[:n]
+	}
+
+	if len(errs) > 0 {
+		msg := fmt.Sprintf("Failed to list keys on peer(s): %s", fanOutError(errs))
+		log.Errorf(msg)
+		c.JSON(500, gin.H{"keys": owners, "error": msg})
+		return
+	}
+	c.JSON(200, gin.H{"keys": owners, "error": ""})
+}
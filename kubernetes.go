@@ -0,0 +1,491 @@
+// SPDX-FileCopyrightText: 2022 Marshall Wace <opensource@mwam.com>
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+	k8sRetryInterval  = 5 * time.Second
+	k8sWatchTimeout   = 300
+	// Seconds past k8sWatchTimeout a watch is abandoned if the API server hasn't ended it
+	k8sWatchTimeoutMargin = 30
+)
+
+var (
+	peersK8sService string
+	kubeconfigPath  string
+)
+
+// k8sClient is a minimal Kubernetes API client, enough to list and watch EndpointSlices or Endpoints
+type k8sClient struct {
+	server    string
+	namespace string
+	token     string
+	tokenFile string
+	client    *http.Client
+}
+
+type k8sEndpoints struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Subsets []struct {
+		Addresses []struct {
+			IP string `json:"ip"`
+		} `json:"addresses"`
+		Ports []struct {
+			Name string `json:"name"`
+			Port int    `json:"port"`
+		} `json:"ports"`
+	} `json:"subsets"`
+}
+
+type k8sEndpointSlice struct {
+	Metadata struct {
+		Name            string `json:"name"`
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Endpoints []struct {
+		Addresses  []string `json:"addresses"`
+		Conditions struct {
+			Ready *bool `json:"ready"`
+		} `json:"conditions"`
+	} `json:"endpoints"`
+	Ports []struct {
+		Name string `json:"name"`
+		Port int    `json:"port"`
+	} `json:"ports"`
+}
+
+type k8sEndpointSliceList struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Items []k8sEndpointSlice `json:"items"`
+}
+
+// k8sAPIError is a non 200 response from the Kubernetes API
+type k8sAPIError struct {
+	path   string
+	status int
+	body   string
+}
+
+func (e *k8sAPIError) Error() string {
+	return fmt.Sprintf("%s returned %d: %s", e.path, e.status, e.body)
+}
+
+type k8sWatchEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+type kubeconfig struct {
+	CurrentContext string `yaml:"current-context"`
+	Clusters       []struct {
+		Name    string `yaml:"name"`
+		Cluster struct {
+			Server                   string `yaml:"server"`
+			CertificateAuthority     string `yaml:"certificate-authority"`
+			CertificateAuthorityData string `yaml:"certificate-authority-data"`
+			InsecureSkipTLSVerify    bool   `yaml:"insecure-skip-tls-verify"`
+		} `yaml:"cluster"`
+	} `yaml:"clusters"`
+	Users []struct {
+		Name string `yaml:"name"`
+		User struct {
+			Token                 string `yaml:"token"`
+			TokenFile             string `yaml:"tokenFile"`
+			ClientCertificate     string `yaml:"client-certificate"`
+			ClientCertificateData string `yaml:"client-certificate-data"`
+			ClientKey             string `yaml:"client-key"`
+			ClientKeyData         string `yaml:"client-key-data"`
+		} `yaml:"user"`
+	} `yaml:"users"`
+	Contexts []struct {
+		Name    string `yaml:"name"`
+		Context struct {
+			Cluster   string `yaml:"cluster"`
+			User      string `yaml:"user"`
+			Namespace string `yaml:"namespace"`
+		} `yaml:"context"`
+	} `yaml:"contexts"`
+}
+
+// discoverPeersK8s keeps the cluster membership in sync with the ready addresses of a
+// Kubernetes service's EndpointSlices, or its Endpoints on clusters without the EndpointSlice
+// API, listing them then watching for changes. Errors keep the current peers and retry
+func discoverPeersK8s() {
+	client, err := newK8sClient(kubeconfigPath)
+	if err != nil {
+		log.Fatalf("Failed to configure Kubernetes peer discovery: %v", err)
+	}
+	namespace, service := client.namespace, peersK8sService
+	if i := strings.Index(service, "/"); i >= 0 {
+		namespace, service = service[:i], service[i+1:]
+	}
+
+	useSlices := true
+	for {
+		watch := client.watchEndpointSlices
+		if !useSlices {
+			watch = client.watchEndpoints
+		}
+		err := watch(namespace, service)
+		var apiErr *k8sAPIError
+		if useSlices && errors.As(err, &apiErr) && apiErr.status == http.StatusNotFound {
+			log.Warnf("EndpointSlice API not available, watching Endpoints of '%s/%s' instead", namespace, service)
+			useSlices = false
+			continue
+		}
+		if err != nil {
+			log.Errorf("Failed to discover peers from Kubernetes service '%s/%s': %v", namespace, service, err)
+			time.Sleep(k8sRetryInterval)
+		}
+	}
+}
+
+// watchEndpointSlices lists a service's EndpointSlices and watches them from that version until
+// the watch times out or fails. A service can have several slices, so peers are merged from all
+func (k *k8sClient) watchEndpointSlices(namespace string, service string) error {
+	path := fmt.Sprintf("/apis/discovery.k8s.io/v1/namespaces/%s/endpointslices", url.PathEscape(namespace))
+	selector := "kubernetes.io/service-name=" + service
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	list := k8sEndpointSliceList{}
+	if err := k.getJSON(ctx, path+"?"+url.Values{"labelSelector": {selector}}.Encode(), &list); err != nil {
+		return err
+	}
+	slices := map[string][]string{}
+	for _, slice := range list.Items {
+		slices[slice.Metadata.Name] = endpointSlicePeers(slice)
+	}
+	setPeers(mergeSlicePeers(slices))
+
+	query := url.Values{
+		"labelSelector":   {selector},
+		"resourceVersion": {list.Metadata.ResourceVersion},
+		"timeoutSeconds":  {strconv.Itoa(k8sWatchTimeout)},
+		"watch":           {"true"},
+	}
+	return k.watch(path+"?"+query.Encode(), func(eventType string, object json.RawMessage) error {
+		slice := k8sEndpointSlice{}
+		if err := json.Unmarshal(object, &slice); err != nil {
+			return fmt.Errorf("invalid watch event: %v", err)
+		}
+		if eventType == "DELETED" {
+			delete(slices, slice.Metadata.Name)
+		} else {
+			slices[slice.Metadata.Name] = endpointSlicePeers(slice)
+		}
+		setPeers(mergeSlicePeers(slices))
+		return nil
+	})
+}
+
+// endpointSlicePeers returns peer URLs for an EndpointSlice's ready addresses, on its port named
+// 'http', its only port, or else -port. Endpoints of unknown readiness are taken as ready
+func endpointSlicePeers(slice k8sEndpointSlice) []string {
+	peerPort := port
+	for _, p := range slice.Ports {
+		if p.Name == "http" || len(slice.Ports) == 1 {
+			peerPort = p.Port
+			break
+		}
+	}
+	discovered := []string{}
+	for _, endpoint := range slice.Endpoints {
+		if endpoint.Conditions.Ready != nil && !*endpoint.Conditions.Ready {
+			continue
+		}
+		for _, address := range endpoint.Addresses {
+			discovered = append(discovered, peerScheme()+"://"+net.JoinHostPort(address, strconv.Itoa(peerPort)))
+		}
+	}
+	return discovered
+}
+
+func mergeSlicePeers(slices map[string][]string) []string {
+	discovered := []string{}
+	for _, slicePeers := range slices {
+		discovered = append(discovered, slicePeers...)
+	}
+	return discovered
+}
+
+// watchEndpoints lists a service's Endpoints and watches them from that version until the
+// watch times out or fails
+func (k *k8sClient) watchEndpoints(namespace string, service string) error {
+	path := fmt.Sprintf("/api/v1/namespaces/%s/endpoints", url.PathEscape(namespace))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	endpoints := k8sEndpoints{}
+	if err := k.getJSON(ctx, path+"/"+url.PathEscape(service), &endpoints); err != nil {
+		return err
+	}
+	setPeers(endpointsPeers(endpoints))
+
+	query := url.Values{
+		"fieldSelector":   {"metadata.name=" + service},
+		"resourceVersion": {endpoints.Metadata.ResourceVersion},
+		"timeoutSeconds":  {strconv.Itoa(k8sWatchTimeout)},
+		"watch":           {"true"},
+	}
+	return k.watch(path+"?"+query.Encode(), func(eventType string, object json.RawMessage) error {
+		if eventType == "DELETED" {
+			setPeers(nil)
+			return nil
+		}
+		endpoints := k8sEndpoints{}
+		if err := json.Unmarshal(object, &endpoints); err != nil {
+			return fmt.Errorf("invalid watch event: %v", err)
+		}
+		setPeers(endpointsPeers(endpoints))
+		return nil
+	})
+}
+
+// watch streams the events of a watch request to handle until it times out or fails. The API
+// server ends watches after timeoutSeconds, the context also ends ones on silently dropped connections
+func (k *k8sClient) watch(path string, handle func(eventType string, object json.RawMessage) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*time.Duration(k8sWatchTimeout+k8sWatchTimeoutMargin))
+	defer cancel()
+	res, err := k.do(ctx, path)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	decoder := json.NewDecoder(res.Body)
+	for {
+		event := k8sWatchEvent{}
+		if err := decoder.Decode(&event); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return fmt.Errorf("watch failed: %v", err)
+		}
+
+		switch event.Type {
+		case "ADDED", "MODIFIED", "DELETED":
+			if err := handle(event.Type, event.Object); err != nil {
+				return err
+			}
+		case "ERROR":
+			// Usually an expired resourceVersion, relist
+			return fmt.Errorf("watch error: %s", strings.TrimSpace(string(event.Object)))
+		}
+	}
+}
+
+// endpointsPeers returns peer URLs for an Endpoints' ready addresses, on their port named
+// 'http', their only port, or else -port
+func endpointsPeers(endpoints k8sEndpoints) []string {
+	discovered := []string{}
+	for _, subset := range endpoints.Subsets {
+		peerPort := port
+		for _, p := range subset.Ports {
+			if p.Name == "http" || len(subset.Ports) == 1 {
+				peerPort = p.Port
+				break
+			}
+		}
+		for _, address := range subset.Addresses {
+			discovered = append(discovered, peerScheme()+"://"+net.JoinHostPort(address.IP, strconv.Itoa(peerPort)))
+		}
+	}
+	return discovered
+}
+
+func (k *k8sClient) getJSON(ctx context.Context, path string, out interface{}) error {
+	res, err := k.do(ctx, path)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+func (k *k8sClient) do(ctx context.Context, path string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, k.server+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	token := k.token
+	if k.tokenFile != "" {
+		// Re-read every time as projected service account tokens are rotated
+		content, err := ioutil.ReadFile(k.tokenFile)
+		if err != nil {
+			return nil, err
+		}
+		token = strings.TrimSpace(string(content))
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	res, err := k.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		defer res.Body.Close()
+		body, _ := ioutil.ReadAll(res.Body)
+		return nil, &k8sAPIError{path, res.StatusCode, strings.TrimSpace(string(body))}
+	}
+	return res, nil
+}
+
+// newK8sClient configures a client from a kubeconfig file, or from the pod's service account
+// when running in a cluster
+func newK8sClient(kubeconfigPath string) (*k8sClient, error) {
+	if kubeconfigPath != "" {
+		return newK8sClientFromKubeconfig(kubeconfigPath)
+	}
+
+	apiHost, apiPort := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if apiHost == "" || apiPort == "" {
+		return nil, errors.New("not running in a Kubernetes cluster, set -kubeconfig")
+	}
+	namespace, err := ioutil.ReadFile(serviceAccountDir + "/namespace")
+	if err != nil {
+		return nil, err
+	}
+	caData, err := ioutil.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := k8sTLSConfig(caData, false, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &k8sClient{
+		server:    "https://" + net.JoinHostPort(apiHost, apiPort),
+		namespace: strings.TrimSpace(string(namespace)),
+		tokenFile: serviceAccountDir + "/token",
+		client:    newK8sHTTPClient(tlsConfig),
+	}, nil
+}
+
+func newK8sClientFromKubeconfig(path string) (*k8sClient, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config := kubeconfig{}
+	if err := yaml.Unmarshal(content, &config); err != nil {
+		return nil, fmt.Errorf("kubeconfig unparsable: %v", err)
+	}
+
+	k := &k8sClient{namespace: "default"}
+	var clusterName, userName string
+	for _, c := range config.Contexts {
+		if c.Name == config.CurrentContext {
+			clusterName, userName = c.Context.Cluster, c.Context.User
+			if c.Context.Namespace != "" {
+				k.namespace = c.Context.Namespace
+			}
+		}
+	}
+	if clusterName == "" {
+		return nil, fmt.Errorf("kubeconfig current-context '%s' not found", config.CurrentContext)
+	}
+
+	var caData, certData, keyData []byte
+	insecure := false
+	for _, c := range config.Clusters {
+		if c.Name == clusterName {
+			k.server = strings.TrimSuffix(c.Cluster.Server, "/")
+			insecure = c.Cluster.InsecureSkipTLSVerify
+			if caData, err = kubeconfigData(c.Cluster.CertificateAuthorityData, c.Cluster.CertificateAuthority); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if k.server == "" {
+		return nil, fmt.Errorf("kubeconfig cluster '%s' not found", clusterName)
+	}
+	for _, u := range config.Users {
+		if u.Name == userName {
+			k.token, k.tokenFile = u.User.Token, u.User.TokenFile
+			if certData, err = kubeconfigData(u.User.ClientCertificateData, u.User.ClientCertificate); err != nil {
+				return nil, err
+			}
+			if keyData, err = kubeconfigData(u.User.ClientKeyData, u.User.ClientKey); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	tlsConfig, err := k8sTLSConfig(caData, insecure, certData, keyData)
+	if err != nil {
+		return nil, err
+	}
+	k.client = newK8sHTTPClient(tlsConfig)
+	return k, nil
+}
+
+// newK8sHTTPClient returns a client for the API server, with keepalives to notice dropped connections
+func newK8sHTTPClient(tlsConfig *tls.Config) *http.Client {
+	return &http.Client{Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout:   10 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSClientConfig:     tlsConfig,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}}
+}
+
+// kubeconfigData returns inline base64 data, else the content of the referenced file
+func kubeconfigData(data string, path string) ([]byte, error) {
+	if data != "" {
+		return base64.StdEncoding.DecodeString(data)
+	}
+	if path != "" {
+		return ioutil.ReadFile(path)
+	}
+	return nil, nil
+}
+
+func k8sTLSConfig(caData []byte, insecure bool, certData []byte, keyData []byte) (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: insecure}
+	if len(caData) > 0 {
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caData) {
+			return nil, errors.New("invalid Kubernetes CA certificate")
+		}
+	}
+	if len(certData) > 0 {
+		cert, err := tls.X509KeyPair(certData, keyData)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Kubernetes client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
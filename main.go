@@ -55,16 +55,69 @@ func init() {
 		"Max memory in megabytes for /upload multipart form parsing")
 	flag.Int64Var(&maxCacheSize, "max-cache-size", 512,
 		"Max cache size in megabytes. If size goes above, oldest keys will be evicted")
+	flag.Int64Var(&maxCacheableSize, "max-cacheable-object-size", 0,
+		"Max object size in megabytes to cache, larger objects are streamed from S3 (default 0, no limit)")
+	flag.Int64Var(&cacheBlockSize, "cache-block-size", 0,
+		"Cache objects larger than this many megabytes as blocks of this size, sharded across peers (default 0, disabled)")
+	flag.Int64Var(&maxMetadataCacheSize, "max-metadata-cache-size", 16,
+		"Max object metadata cache size in megabytes, used to answer HEAD requests")
+	flag.StringVar(&diskCacheDir, "disk-cache-dir", "",
+		"Directory for the on-disk cache tier beneath memory, kept across restarts (default '', disabled)")
+	flag.Int64Var(&diskCacheSize, "disk-cache-size", 10240,
+		"Max disk cache size in megabytes. If size goes above, least recently used blobs will be evicted")
 	flag.IntVar(&ttl, "ttl", 60, "Blob time-to-live in cache in minutes (0 to never expire)")
+	flag.IntVar(&negativeTTL, "negative-ttl", 0,
+		"Time-to-live in seconds for caching keys missing in S3, so repeated misses are served locally (default 0, disabled)")
+	flag.IntVar(&staleWhileRevalidate, "stale-while-revalidate", 0,
+		"Seconds to keep serving expired blobs while they are refreshed from S3 in the background (default 0, disabled)")
+	flag.IntVar(&staleIfError, "stale-if-error", 0,
+		"Seconds to keep serving expired blobs if refreshing them from S3 fails (default 0, disabled)")
+	flag.IntVar(&revalidateWindow, "revalidate-window", 0,
+		"Minutes to keep expired blobs so they can be revalidated by ETag instead of downloaded again (default 0, disabled)")
+	flag.StringVar(&ttlRulesPath, "ttl-rules-path", "",
+		"Path to JSON file of per bucket/prefix TTL rules overriding -ttl (default '', no rules)")
 	flag.BoolVar(&cacheOnWrite, "cache-on-write", false, "Enable automatic caching on uploads (default false)")
+	flag.IntVar(&prewarmConcurrency, "prewarm-concurrency", 10,
+		"Keys fetched at the same time by a prewarm job, unless set with its 'concurrency' parameter")
 	flag.IntVar(&timeout, "timeout", 5000, "Get blob timeout in milliseconds")
 	flag.StringVar(&peersFlag, "peers", "",
 		"Peers (default '', e.g. 'http://peer1:8080,http://peer2:8080')")
+	flag.StringVar(&peersDNS, "peers-dns", "",
+		"DNS name to discover peers from, A records (e.g. a headless service) or SRV records if prefixed by '_' (default '', disabled)")
+	flag.IntVar(&peersDNSInterval, "peers-dns-interval", 30, "Seconds between peer DNS lookups")
+	flag.StringVar(&peersK8sService, "peers-k8s-service", "",
+		"Kubernetes service ('name' or 'namespace/name') whose ready endpoints are watched as peers (default '', disabled)")
+	flag.StringVar(&kubeconfigPath, "kubeconfig", "",
+		"Path to kubeconfig for -peers-k8s-service (default '', in-cluster service account)")
+	flag.StringVar(&gossipSeedsFlag, "gossip-seeds", "",
+		"Seed nodes to join a cluster through, keeping members by gossip (default '', disabled, e.g. 'http://seed1:8080,http://seed2:8080')")
+	flag.IntVar(&gossipInterval, "gossip-interval", 1, "Seconds between gossip rounds")
+	flag.IntVar(&gossipSuspicionTimeout, "gossip-suspicion-timeout", 10,
+		"Seconds without news from a gossip member before it's dropped from the peers")
+	flag.IntVar(&peerFailureThreshold, "peer-failure-threshold", 3,
+		"Consecutive failed requests to a peer before its keys are loaded from S3 locally until it's retried")
+	flag.IntVar(&peerRetryBackoff, "peer-retry-backoff", 5,
+		"Seconds before retrying an unhealthy peer, doubled each time it's still failing (up to 5 minutes)")
+	flag.IntVar(&replicationFactor, "replication-factor", 1,
+		"Number of peers owning each key, reads are spread across them and fail over between them")
+	flag.Int64Var(&maxReplicaCacheSize, "max-replica-cache-size", 128,
+		"Max size in megabytes of blobs cached as a replica for other owners, with -replication-factor above 1")
 	flag.BoolVar(&disableHttpMetricsFlag, "disable-http-metrics", false,
 		"Disable HTTP metrics (req/s, latency) when expecting high path cardinality (default false)")
+	flag.StringVar(&tlsCertFlag, "tls-cert", "",
+		"Path to PEM certificate to serve HTTPS with, also presented to peers (default '', plain HTTP)")
+	flag.StringVar(&tlsKeyFlag, "tls-key", "", "Path to PEM private key of -tls-cert")
+	flag.StringVar(&tlsClientCAFlag, "tls-client-ca", "",
+		"Path to PEM CA bundle clients and peers must present certificates from, also trusted for peers (default '', no mTLS)")
+	flag.StringVar(&peerSecretFlag, "peer-secret", "",
+		"Shared secret peers sign /_groupcache requests with, exempting them from JWT auth (default '', disabled)")
+	flag.StringVar(&peerTLSNamesFlag, "peer-tls-names", "",
+		"Client certificate names (CN or DNS SAN) allowed on /_groupcache routes without JWT, with -tls-client-ca (default '', disabled)")
 	flag.StringVar(&jwtRsaPubKeyFlag, "jwt-rsa-publickey-path", "", "Path to JWT RSA public key file")
 	flag.StringVar(&jwtIssuerFlag, "jwt-issuer", "", "JWT issuer claim")
 	flag.StringVar(&jwtAudienceFlag, "jwt-audience", "", "JWT audience claim")
+	flag.StringVar(&adminTokenFlag, "admin-token", "",
+		"Bearer token for the /admin API when JWT auth is disabled (default '', admin API disabled without JWT)")
 	flag.StringVar(&logLevel, "log-level", "info", "Logging level (info, debug, error, warn)")
 	flag.BoolVar(&versionFlag, "version", false, "Version")
 	flag.BoolVar(&readOnly, "read-only", false, "Read only mode, disable upload and delete operations to S3 (default false)")
@@ -74,9 +127,19 @@ func init() {
 func main() {
 	checkFlags()
 	initS3()
+	initDiskCache()
 	initCachePool()
 	initMetrics()
 	go collectMetrics()
+	if peersDNS != "" {
+		go discoverPeersDNS()
+	}
+	if peersK8sService != "" {
+		go discoverPeersK8s()
+	}
+	if len(gossipSeeds) > 0 {
+		go runGossip()
+	}
 	runServer()
 }
 
@@ -99,12 +162,63 @@ func checkFlags() {
 		os.Exit(0)
 	}
 
-	peers = []string{}
+	if (tlsCertFlag == "") != (tlsKeyFlag == "") {
+		log.Fatalf("tls-cert and tls-key must be set together")
+	}
+	if tlsClientCAFlag != "" && tlsCertFlag == "" {
+		log.Fatalf("tls-client-ca requires tls-cert and tls-key")
+	}
+	initTLS()
+
+	parsePeerTLSNames()
+	if len(peerTLSNames) > 0 && tlsClientCAFlag == "" {
+		log.Fatalf("peer-tls-names requires tls-client-ca to verify peer certificates")
+	}
+	initPeerAuth()
+
+	staticPeers = []string{}
 	if peersFlag != "" {
-		peers = strings.Split(peersFlag, ",")
-		peers = cleanupPeers(peers)
+		staticPeers = strings.Split(peersFlag, ",")
+		staticPeers = cleanupPeers(staticPeers)
+	}
+
+	gossipSeeds = []string{}
+	if gossipSeedsFlag != "" {
+		gossipSeeds = cleanupPeers(strings.Split(gossipSeedsFlag, ","))
+	}
+	discoveries := 0
+	for _, enabled := range []bool{peersDNS != "", peersK8sService != "", len(gossipSeeds) > 0} {
+		if enabled {
+			discoveries++
+		}
+	}
+	if discoveries > 1 {
+		log.Fatalf("Use only one of peers-dns, peers-k8s-service or gossip-seeds")
+	}
+	if len(gossipSeeds) > 0 && (gossipInterval <= 0 || gossipSuspicionTimeout <= gossipInterval) {
+		log.Fatalf("gossip-interval must be positive and below gossip-suspicion-timeout")
+	}
+	if peerFailureThreshold < 1 || peerRetryBackoff < 1 {
+		log.Fatalf("peer-failure-threshold and peer-retry-backoff must be positive")
+	}
+	if prewarmConcurrency < 1 || prewarmConcurrency > maxPrewarmConcurrency {
+		log.Fatalf("prewarm-concurrency must be between 1 and %d: %d", maxPrewarmConcurrency, prewarmConcurrency)
+	}
+	if replicationFactor < 1 {
+		log.Fatalf("replication-factor must be at least 1: %d", replicationFactor)
+	}
+	if peersDNS != "" && peersDNSInterval <= 0 {
+		log.Fatalf("peers-dns-interval must be positive: %d", peersDNSInterval)
+	}
+	if jwtRsaPubKeyFlag != "" && !peerAuthEnabled() && (len(staticPeers) > 0 || discoveries > 0) {
+		log.Warnf("JWT auth applies to peer requests, set -peer-secret or -peer-tls-names for peers to reach each other")
+	}
+	if (peersDNS != "" || peersK8sService != "") && host == "localhost" {
+		log.Warnf("Discovering peers with -host localhost, set it to this node's IP to identify self")
 	}
 
+	loadTTLRules()
+
 	if jwtRsaPubKeyFlag != "" {
 		content, err := ioutil.ReadFile(jwtRsaPubKeyFlag)
 		if err != nil {
@@ -160,9 +274,27 @@ func runServer() {
 	router.GET("/list", restS3List)
 	router.GET("/get", restCacheGet)
 	router.POST("/prewarm", restCachePrewarm)
+	router.GET("/prewarm/:id", restPrewarmStatus)
+	router.DELETE("/prewarm/:id", restPrewarmCancel)
 	router.POST("/invalidate", restCacheInvalidate)
-	router.GET("/_groupcache/s3/*blob", gin.WrapF(cachePool.ServeHTTP))
-	router.DELETE("/_groupcache/s3/*blob", gin.WrapF(cachePool.ServeHTTP))
+	router.GET("/cache/keys", restCacheKeys)
+	router.GET("/cache/owner", restCacheOwner)
+
+	peer := router.Group("/_groupcache", peerAuthMiddleware())
+	peer.GET("/s3/*blob", serveGroupcache)
+	peer.DELETE("/s3/*blob", serveGroupcache)
+	peer.POST("/s3/*blob", serveRefresh)
+	peer.GET("/s3-meta/*blob", serveGroupcache)
+	peer.DELETE("/s3-meta/*blob", serveGroupcache)
+	peer.POST("/invalidate", serveInvalidate)
+	peer.GET("/replica/*blob", serveReplica)
+	peer.GET("/keys", serveKeys)
+	peer.POST("/gossip", serveGossip)
+	peer.PUT("/peers", peerAdminMiddleware(), serveSetPeers)
+
+	admin := router.Group("/admin", adminMiddleware())
+	admin.GET("/peers", restAdminGetPeers)
+	admin.PUT("/peers", restAdminSetPeers)
 
 	router.GET("/healthz", func(c *gin.Context) {
 		c.String(200, fmt.Sprintf("Version: %s", version))
@@ -186,6 +318,9 @@ func runServer() {
 		Addr:    listenAddr,
 		Handler: router,
 	}
+	if tlsCertFlag != "" {
+		server.TLSConfig = serverTLSConfig()
+	}
 
 	fmt.Println(`
 		┌────────────────────────────────────────┐
@@ -199,8 +334,14 @@ func runServer() {
 	go runMetricsServer()
 	go serverGracefulShutdown(server, quit, done)
 
-	log.Infof("HTTP server is ready to handle requests at %s", listenAddr)
-	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+	log.Infof("HTTP server is ready to handle requests at %s://%s", peerScheme(), listenAddr)
+	var err error
+	if tlsCertFlag != "" {
+		err = server.ListenAndServeTLS(tlsCertFlag, tlsKeyFlag)
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err != nil && err != http.ErrServerClosed {
 		log.Fatalf("HTTP server could not listen on %s: %v\n", listenAddr, err)
 	}
 
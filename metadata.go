@@ -0,0 +1,196 @@
+// SPDX-FileCopyrightText: 2022 Marshall Wace <opensource@mwam.com>
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/gin-gonic/gin"
+	"github.com/mailgun/groupcache/v2"
+)
+
+// Cached values are laid out as <blob bytes><metadata JSON><uint32 metadata length>,
+// so the blob can be served as a slice of the cached ByteView without copying
+const metadataTrailerSize = 4
+
+var errCorruptCacheEntry = errors.New("corrupt cache entry")
+
+// objectMetadata holds the S3 object headers cached alongside the blob bytes
+type objectMetadata struct {
+	ContentLength        int64             `json:"contentLength"`
+	ETag                 string            `json:"etag,omitempty"`
+	LastModified         time.Time         `json:"lastModified,omitempty"`
+	ContentType          string            `json:"contentType,omitempty"`
+	ContentEncoding      string            `json:"contentEncoding,omitempty"`
+	ContentDisposition   string            `json:"contentDisposition,omitempty"`
+	ContentLanguage      string            `json:"contentLanguage,omitempty"`
+	CacheControl         string            `json:"cacheControl,omitempty"`
+	Expires              string            `json:"expires,omitempty"`
+	VersionId            string            `json:"versionId,omitempty"`
+	StorageClass         string            `json:"storageClass,omitempty"`
+	ServerSideEncryption string            `json:"serverSideEncryption,omitempty"`
+	Metadata             map[string]string `json:"metadata,omitempty"`
+	// Negative cache entry for a key missing in S3
+	NotFound bool `json:"notFound,omitempty"`
+	// When the entry goes stale, zero if it's only dropped on expiry
+	FreshUntil time.Time `json:"freshUntil,omitempty"`
+}
+
+func metadataFromGetObject(res *s3.GetObjectOutput) objectMetadata {
+	meta := objectMetadata{
+		ContentLength:        aws.Int64Value(res.ContentLength),
+		ETag:                 aws.StringValue(res.ETag),
+		LastModified:         aws.TimeValue(res.LastModified),
+		ContentType:          aws.StringValue(res.ContentType),
+		ContentEncoding:      aws.StringValue(res.ContentEncoding),
+		ContentDisposition:   aws.StringValue(res.ContentDisposition),
+		ContentLanguage:      aws.StringValue(res.ContentLanguage),
+		CacheControl:         aws.StringValue(res.CacheControl),
+		Expires:              aws.StringValue(res.Expires),
+		VersionId:            aws.StringValue(res.VersionId),
+		StorageClass:         aws.StringValue(res.StorageClass),
+		ServerSideEncryption: aws.StringValue(res.ServerSideEncryption),
+		Metadata:             aws.StringValueMap(res.Metadata),
+	}
+
+	// Ranged (multipart) downloads report the part length, the full size is after the '/'
+	if res.ContentRange != nil {
+		if i := strings.LastIndex(*res.ContentRange, "/"); i >= 0 {
+			if size, err := strconv.ParseInt((*res.ContentRange)[i+1:], 10, 64); err == nil {
+				meta.ContentLength = size
+			}
+		}
+	}
+
+	return meta
+}
+
+func metadataFromHeadObject(res *s3.HeadObjectOutput) objectMetadata {
+	return objectMetadata{
+		ContentLength:        aws.Int64Value(res.ContentLength),
+		ETag:                 aws.StringValue(res.ETag),
+		LastModified:         aws.TimeValue(res.LastModified),
+		ContentType:          aws.StringValue(res.ContentType),
+		ContentEncoding:      aws.StringValue(res.ContentEncoding),
+		ContentDisposition:   aws.StringValue(res.ContentDisposition),
+		ContentLanguage:      aws.StringValue(res.ContentLanguage),
+		CacheControl:         aws.StringValue(res.CacheControl),
+		Expires:              aws.StringValue(res.Expires),
+		VersionId:            aws.StringValue(res.VersionId),
+		StorageClass:         aws.StringValue(res.StorageClass),
+		ServerSideEncryption: aws.StringValue(res.ServerSideEncryption),
+		Metadata:             aws.StringValueMap(res.Metadata),
+	}
+}
+
+func encodeCacheEntry(meta objectMetadata, body []byte) ([]byte, error) {
+	metaBytes, err := json.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+
+	entry := make([]byte, len(body)+len(metaBytes)+metadataTrailerSize)
+	n := copy(entry, body)
+	n += copy(entry[n:], metaBytes)
+	binary.BigEndian.PutUint32(entry[n:], uint32(len(metaBytes)))
+	return entry, nil
+}
+
+// decodeCacheEntry splits a cached value into its metadata and a view of the blob bytes
+func decodeCacheEntry(view groupcache.ByteView) (objectMetadata, groupcache.ByteView, error) {
+	size := view.Len()
+	if size < metadataTrailerSize {
+		return objectMetadata{}, view, errCorruptCacheEntry
+	}
+
+	bodyLen, err := cacheEntryBodyLen(view.SliceFrom(size-metadataTrailerSize).ByteSlice(), size)
+	if err != nil {
+		return objectMetadata{}, view, err
+	}
+	meta, err := unmarshalMetadata(view.Slice(bodyLen, size-metadataTrailerSize).ByteSlice())
+	return meta, view.Slice(0, bodyLen), err
+}
+
+// decodeCacheMetadata reads only the metadata of an encoded cache entry
+func decodeCacheMetadata(entry []byte) (objectMetadata, error) {
+	size := len(entry)
+	if size < metadataTrailerSize {
+		return objectMetadata{}, errCorruptCacheEntry
+	}
+
+	bodyLen, err := cacheEntryBodyLen(entry[size-metadataTrailerSize:], size)
+	if err != nil {
+		return objectMetadata{}, err
+	}
+	return unmarshalMetadata(entry[bodyLen : size-metadataTrailerSize])
+}
+
+func cacheEntryBodyLen(trailer []byte, size int) (int, error) {
+	metaLen := int(binary.BigEndian.Uint32(trailer))
+	bodyLen := size - metadataTrailerSize - metaLen
+	if bodyLen < 0 {
+		return 0, errCorruptCacheEntry
+	}
+	return bodyLen, nil
+}
+
+func unmarshalMetadata(metaBytes []byte) (objectMetadata, error) {
+	meta := objectMetadata{}
+	if err := json.Unmarshal(metaBytes, &meta); err != nil {
+		return meta, errCorruptCacheEntry
+	}
+	return meta, nil
+}
+
+func (meta objectMetadata) contentType() string {
+	if meta.ContentType == "" {
+		return "application/octet-stream"
+	}
+	return meta.ContentType
+}
+
+// setMetadataHeaders replays the cached S3 object headers on the response
+func setMetadataHeaders(c *gin.Context, meta objectMetadata) {
+	if meta.ETag != "" {
+		c.Header("ETag", meta.ETag)
+	}
+	if !meta.LastModified.IsZero() {
+		c.Header("Last-Modified", meta.LastModified.UTC().Format(http.TimeFormat))
+	}
+	if meta.ContentEncoding != "" {
+		c.Header("Content-Encoding", meta.ContentEncoding)
+	}
+	if meta.ContentDisposition != "" {
+		c.Header("Content-Disposition", meta.ContentDisposition)
+	}
+	if meta.ContentLanguage != "" {
+		c.Header("Content-Language", meta.ContentLanguage)
+	}
+	if meta.CacheControl != "" {
+		c.Header("Cache-Control", meta.CacheControl)
+	}
+	if meta.Expires != "" {
+		c.Header("Expires", meta.Expires)
+	}
+	if meta.VersionId != "" {
+		c.Header("x-amz-version-id", meta.VersionId)
+	}
+	if meta.StorageClass != "" {
+		c.Header("x-amz-storage-class", meta.StorageClass)
+	}
+	if meta.ServerSideEncryption != "" {
+		c.Header("x-amz-server-side-encryption", meta.ServerSideEncryption)
+	}
+	for k, v := range meta.Metadata {
+		c.Header("x-amz-meta-"+strings.ToLower(k), v)
+	}
+}
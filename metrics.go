@@ -31,11 +31,24 @@ var (
 	groupLocalLoadsMetric             prometheus.Gauge
 	groupLocalLoadErrsMetric          prometheus.Gauge
 	groupServerRequestsMetric         prometheus.Gauge
+	peersMetric                       prometheus.GaugeFunc
+	replicaReadsMetric                *prometheus.CounterVec
+	peerCircuitOpenMetric             *prometheus.GaugeVec
+	replicaCacheBytesMetric           prometheus.GaugeFunc
 	cacheBytesMetric                  *prometheus.GaugeVec
 	cacheItemsMetric                  *prometheus.GaugeVec
 	cacheGetsMetric                   *prometheus.GaugeVec
 	cacheHitsMetric                   *prometheus.GaugeVec
 	cacheEvictionsMetric              *prometheus.GaugeVec
+	cacheBypassMetric                 *prometheus.CounterVec
+	cacheStaleMetric                  *prometheus.CounterVec
+	cacheRefreshMetric                *prometheus.CounterVec
+	diskCacheBytesMetric              prometheus.Gauge
+	diskCacheItemsMetric              prometheus.Gauge
+	diskCacheHitsMetric               prometheus.Gauge
+	diskCacheMissesMetric             prometheus.Gauge
+	diskCacheEvictionsMetric          prometheus.Gauge
+	diskCacheCorruptedMetric          prometheus.Gauge
 )
 
 func initMetrics() {
@@ -91,6 +104,22 @@ func initMetrics() {
 		Name: "cachenator_server_requests_total",
 		Help: "Total number of gets from other peers",
 	})
+	peersMetric = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "cachenator_peers",
+		Help: "Current number of peers in the cluster, including self",
+	}, func() float64 { return float64(peerCount()) })
+	replicaReadsMetric = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cachenator_replica_reads_total",
+		Help: "Total number of replicated key reads (hit/fill of this node's replicas, failover from unreachable owners)",
+	}, []string{"result"})
+	peerCircuitOpenMetric = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "cachenator_peer_circuit_open",
+		Help: "Whether a peer is considered unhealthy, its keys being loaded from S3 locally (1) or not (0)",
+	}, []string{"peer"})
+	replicaCacheBytesMetric = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "cachenator_replica_cache_bytes",
+		Help: "Current bytes of blobs cached as a replica",
+	}, func() float64 { return float64(replicas.bytes()) })
 	cacheBytesMetric = promauto.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "cachenator_cache_bytes",
 		Help: "Current (main/hot) cache bytes",
@@ -111,23 +140,60 @@ func initMetrics() {
 		Name: "cachenator_cache_evictions_total",
 		Help: "Total number of (main/hot) cache evictions",
 	}, []string{"type"})
+	cacheBypassMetric = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cachenator_cache_bypass_total",
+		Help: "Total number of gets streamed straight from S3 without caching",
+	}, []string{"reason"})
+	cacheStaleMetric = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cachenator_cache_stale_total",
+		Help: "Total number of stale blobs served, while revalidating or on S3 errors",
+	}, []string{"reason"})
+	cacheRefreshMetric = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cachenator_cache_refresh_total",
+		Help: "Total number of expired blob refreshes from S3, including ETag revalidations",
+	}, []string{"result"})
+	diskCacheBytesMetric = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "cachenator_disk_cache_bytes",
+		Help: "Current disk cache bytes",
+	})
+	diskCacheItemsMetric = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "cachenator_disk_cache_items",
+		Help: "Current disk cache items",
+	})
+	diskCacheHitsMetric = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "cachenator_disk_cache_hits_total",
+		Help: "Total number of disk cache hits",
+	})
+	diskCacheMissesMetric = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "cachenator_disk_cache_misses_total",
+		Help: "Total number of disk cache misses",
+	})
+	diskCacheEvictionsMetric = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "cachenator_disk_cache_evictions_total",
+		Help: "Total number of disk cache evictions",
+	})
+	diskCacheCorruptedMetric = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "cachenator_disk_cache_corrupted_total",
+		Help: "Total number of disk cache files failing checksum validation",
+	})
 }
 
 func collectMetrics() {
 	cacheTypes := []groupcache.CacheType{groupcache.MainCache, groupcache.HotCache}
 
 	for {
-		groupGetsMetric.Set(float64(cacheGroup.Stats.Gets.Get()))
-		groupCacheHitsMetric.Set(float64(cacheGroup.Stats.CacheHits.Get()))
+		stats := &cacheGroup.current().Stats
+		groupGetsMetric.Set(float64(stats.Gets.Get()))
+		groupCacheHitsMetric.Set(float64(stats.CacheHits.Get()))
 		groupPeersGetHighestLatencyMetric.Set(
-			float64(cacheGroup.Stats.GetFromPeersLatencyLower.Get()))
-		groupPeerLoadsMetric.Set(float64(cacheGroup.Stats.PeerLoads.Get()))
-		groupPeerErrorsMetric.Set(float64(cacheGroup.Stats.PeerErrors.Get()))
-		groupLoadsMetric.Set(float64(cacheGroup.Stats.Loads.Get()))
-		groupLoadsDedupedMetric.Set(float64(cacheGroup.Stats.LoadsDeduped.Get()))
-		groupLocalLoadsMetric.Set(float64(cacheGroup.Stats.LocalLoads.Get()))
-		groupLocalLoadErrsMetric.Set(float64(cacheGroup.Stats.LocalLoadErrs.Get()))
-		groupServerRequestsMetric.Set(float64(cacheGroup.Stats.ServerRequests.Get()))
+			float64(stats.GetFromPeersLatencyLower.Get()))
+		groupPeerLoadsMetric.Set(float64(stats.PeerLoads.Get()))
+		groupPeerErrorsMetric.Set(float64(stats.PeerErrors.Get()))
+		groupLoadsMetric.Set(float64(stats.Loads.Get()))
+		groupLoadsDedupedMetric.Set(float64(stats.LoadsDeduped.Get()))
+		groupLocalLoadsMetric.Set(float64(stats.LocalLoads.Get()))
+		groupLocalLoadErrsMetric.Set(float64(stats.LocalLoadErrs.Get()))
+		groupServerRequestsMetric.Set(float64(stats.ServerRequests.Get()))
 
 		for _, cacheType := range cacheTypes {
 			cacheBytesMetric.WithLabelValues(cacheTypeName(cacheType)).Set(
@@ -142,6 +208,15 @@ func collectMetrics() {
 				float64(cacheGroup.CacheStats(cacheType).Evictions))
 		}
 
+		if diskCache != nil {
+			diskCacheBytesMetric.Set(float64(diskCache.bytes()))
+			diskCacheItemsMetric.Set(float64(diskCache.items()))
+			diskCacheHitsMetric.Set(float64(diskCache.Stats.Hits.Get()))
+			diskCacheMissesMetric.Set(float64(diskCache.Stats.Misses.Get()))
+			diskCacheEvictionsMetric.Set(float64(diskCache.Stats.Evictions.Get()))
+			diskCacheCorruptedMetric.Set(float64(diskCache.Stats.Corrupted.Get()))
+		}
+
 		time.Sleep(10 * time.Second)
 	}
 }
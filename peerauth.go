@@ -0,0 +1,160 @@
+// SPDX-FileCopyrightText: 2022 Marshall Wace <opensource@mwam.com>
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	peerTimestampHeader = "X-Cachenator-Peer-Timestamp"
+	peerSignatureHeader = "X-Cachenator-Peer-Signature"
+	// Signed peer requests are accepted for this long either side of now, bounding replays
+	peerSignatureMaxSkew = time.Minute
+	// Largest peer request body read to check its signature
+	maxPeerRequestBodySize = 1 << 20
+)
+
+var (
+	peerSecretFlag   string
+	peerTLSNamesFlag string
+	peerTLSNames     []string
+)
+
+// peerAuthEnabled reports whether /_groupcache routes authenticate peers themselves instead
+// of going through client JWT auth
+func peerAuthEnabled() bool {
+	return peerSecretFlag != "" || len(peerTLSNames) > 0
+}
+
+// initPeerAuth signs all peer-to-peer requests with -peer-secret
+func initPeerAuth() {
+	if peerSecretFlag == "" {
+		return
+	}
+	peerHTTPTransport = &peerSigningTransport{base: peerHTTPTransport}
+	peerClient.Transport = peerHTTPTransport
+}
+
+// peerSigningTransport adds a timestamp and its HMAC, with the method, host, URI and a hash of
+// the body, to peer requests
+type peerSigningTransport struct {
+	base http.RoundTripper
+}
+
+func (t *peerSigningTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req = req.Clone(req.Context())
+	body, err := readRequestBody(req)
+	if err != nil {
+		return nil, err
+	}
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	req.Header.Set(peerTimestampHeader, timestamp)
+	req.Header.Set(peerSignatureHeader, peerSignature(req.Method, host, req.URL.RequestURI(), timestamp, body))
+	return t.base.RoundTrip(req)
+}
+
+func peerSignature(method string, host string, uri string, timestamp string, body []byte) string {
+	bodySum := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, []byte(peerSecretFlag))
+	mac.Write([]byte(method + "\n" + host + "\n" + uri + "\n" + timestamp + "\n" + hex.EncodeToString(bodySum[:])))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// readRequestBody reads a request's body for signing, leaving it to be read again
+func readRequestBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, nil
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
+
+// peerAuthMiddleware guards /_groupcache routes, letting through requests signed with
+// -peer-secret or made with a verified client certificate named in -peer-tls-names
+func peerAuthMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !peerAuthEnabled() {
+			return
+		}
+		if peerSecretFlag != "" && validPeerSignature(c.Request) {
+			return
+		}
+		if len(peerTLSNames) > 0 && validPeerCertificate(c.Request) {
+			return
+		}
+		log.Debugf("Peer request from %s without valid peer credentials, returning 401", c.ClientIP())
+		c.JSON(401, gin.H{"error": "Missing or invalid peer credentials"})
+		c.Abort()
+	}
+}
+
+func validPeerSignature(req *http.Request) bool {
+	timestamp := req.Header.Get(peerTimestampHeader)
+	signature := req.Header.Get(peerSignatureHeader)
+	if timestamp == "" || signature == "" {
+		return false
+	}
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	skew := time.Since(time.Unix(seconds, 0))
+	if skew > peerSignatureMaxSkew || skew < -peerSignatureMaxSkew {
+		log.Debugf("Peer request signed %s away from now, rejecting", skew)
+		return false
+	}
+	if req.Body != nil {
+		req.Body = http.MaxBytesReader(nil, req.Body, maxPeerRequestBodySize)
+	}
+	body, err := readRequestBody(req)
+	if err != nil {
+		return false
+	}
+	expected := peerSignature(req.Method, req.Host, req.RequestURI, timestamp, body)
+	return hmac.Equal([]byte(signature), []byte(expected))
+}
+
+// validPeerCertificate checks the verified client certificate's common name and DNS names
+func validPeerCertificate(req *http.Request) bool {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.VerifiedChains[0]) == 0 {
+		return false
+	}
+	cert := req.TLS.VerifiedChains[0][0]
+	for _, name := range append([]string{cert.Subject.CommonName}, cert.DNSNames...) {
+		if containsString(peerTLSNames, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func parsePeerTLSNames() {
+	peerTLSNames = []string{}
+	for _, name := range strings.Split(peerTLSNamesFlag, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			peerTLSNames = append(peerTLSNames, name)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+// SPDX-FileCopyrightText: 2022 Marshall Wace <opensource@mwam.com>
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	ttlRulesPath string
+	ttlRules     []ttlRule
+)
+
+// ttlRule overrides the global TTL for keys matching the bucket and prefix globs, e.g.
+//
+//	{"bucket": "reference-*", "prefix": "", "ttl": 4320}
+//	{"bucket": "intraday", "prefix": "prices/*/latest", "ttl": 5}
+//	{"bucket": "*", "prefix": "tmp/", "cache": false}
+//
+// Rules are evaluated in order and the first match wins
+type ttlRule struct {
+	Bucket string `json:"bucket"`
+	Prefix string `json:"prefix"`
+	// TTL in minutes, 0 to never expire. Defaults to the -ttl flag
+	TTL *int `json:"ttl"`
+	// Set to false to never cache matching keys, streaming them from S3 instead
+	Cache *bool `json:"cache"`
+
+	bucketRegexp *regexp.Regexp
+	prefixRegexp *regexp.Regexp
+}
+
+func loadTTLRules() {
+	if ttlRulesPath == "" {
+		return
+	}
+
+	content, err := ioutil.ReadFile(ttlRulesPath)
+	if err != nil {
+		log.Fatalf("ttl-rules-path invalid: %v.", err)
+	}
+	rules, err := parseTTLRules(content)
+	if err != nil {
+		log.Fatalf("ttl-rules-path unparsable: %v.", err)
+	}
+	ttlRules = rules
+	log.Infof("Loaded %d TTL rule(s) from '%s'", len(ttlRules), ttlRulesPath)
+}
+
+func parseTTLRules(content []byte) ([]ttlRule, error) {
+	rules := []ttlRule{}
+	if err := json.Unmarshal(content, &rules); err != nil {
+		return nil, err
+	}
+
+	for i := range rules {
+		rule := &rules[i]
+		if rule.Bucket == "" {
+			rule.Bucket = "*"
+		}
+		if rule.TTL != nil && *rule.TTL < 0 {
+			return nil, fmt.Errorf("rule %d: ttl must be 0 or more minutes", i)
+		}
+		rule.bucketRegexp = globToRegexp(rule.Bucket, true)
+		rule.prefixRegexp = globToRegexp(rule.Prefix, false)
+	}
+	return rules, nil
+}
+
+// globToRegexp converts a glob where '*' matches any characters (including '/') and '?' matches one
+func globToRegexp(glob string, full bool) *regexp.Regexp {
+	var b strings.Builder
+	b.WriteString("^")
+	for _, r := range glob {
+		switch r {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	if full {
+		b.WriteString("$")
+	}
+	return regexp.MustCompile(b.String())
+}
+
+// matchTTLRule returns the first rule matching a key, with or without the leading '/' the
+// transparent S3 API keys have
+func matchTTLRule(bucket string, key string) *ttlRule {
+	key = strings.TrimPrefix(key, "/")
+	for i := range ttlRules {
+		rule := &ttlRules[i]
+		if rule.bucketRegexp.MatchString(bucket) && rule.prefixRegexp.MatchString(key) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// ttlFor returns the TTL in minutes for a key, 0 meaning never expire
+func ttlFor(bucket string, key string) int {
+	if rule := matchTTLRule(bucket, key); rule != nil && rule.TTL != nil {
+		return *rule.TTL
+	}
+	return ttl
+}
+
+// cachingDisabledFor reports whether a rule says the key should never be cached
+func cachingDisabledFor(bucket string, key string) bool {
+	rule := matchTTLRule(bucket, key)
+	return rule != nil && rule.Cache != nil && !*rule.Cache
+}
+
+func cacheExpiry(minutes int) time.Time {
+	if minutes > 0 {
+		return time.Now().Add(time.Minute * time.Duration(minutes))
+	}
+	// "Disable" TTL - expire in 10 years
+	return time.Now().Add(time.Hour * 87650)
+}
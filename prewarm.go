@@ -0,0 +1,414 @@
+// SPDX-FileCopyrightText: 2022 Marshall Wace <opensource@mwam.com>
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/adrianchifor/go-parallel"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Finished prewarm jobs kept for their status, oldest are dropped first
+	maxFinishedPrewarmJobs = 100
+	// Failed keys listed in a prewarm job's status, the rest are only counted
+	maxPrewarmFailedKeys = 1000
+	// Most keys a single prewarm job fetches at the same time
+	maxPrewarmConcurrency = 100
+	// Largest keys manifest accepted, in bytes and in entries
+	maxPrewarmManifestSize = 16 << 20
+	maxPrewarmManifestKeys = 100000
+)
+
+const (
+	prewarmRunning   = "running"
+	prewarmCompleted = "completed"
+	prewarmCancelled = "cancelled"
+)
+
+var errPrewarmManifestTooLarge = fmt.Errorf("keys manifest is larger than %d MB", maxPrewarmManifestSize>>20)
+
+var (
+	prewarmConcurrency int
+
+	prewarmJobs   = map[string]*prewarmJob{}
+	prewarmJobsMu sync.Mutex
+)
+
+// prewarmKey is an object to pre-warm, listed under a prefix or given in a manifest
+type prewarmKey struct {
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+}
+
+// prewarmJob tracks the progress of pre-warming keys in the background on this node
+type prewarmJob struct {
+	mu          sync.Mutex
+	id          string
+	bucket      string
+	prefix      string
+	concurrency int
+	status      string
+	total       int
+	completed   int
+	failed      int
+	failedKeys  []string
+	bytes       int64
+	started     time.Time
+	finished    time.Time
+	cancel      context.CancelFunc
+	// Bucket and prefix of the JWT token that started the job, which others need to cover
+	scopeBucket string
+	scopePrefix string
+}
+
+type prewarmJobStatus struct {
+	ID          string    `json:"id"`
+	Bucket      string    `json:"bucket,omitempty"`
+	Prefix      string    `json:"prefix,omitempty"`
+	Concurrency int       `json:"concurrency"`
+	Status      string    `json:"status"`
+	Total       int       `json:"total"`
+	Completed   int       `json:"completed"`
+	Failed      int       `json:"failed"`
+	FailedKeys  []string  `json:"failedKeys"`
+	Bytes       int64     `json:"bytes"`
+	Started     time.Time `json:"started"`
+	Duration    float64   `json:"durationSeconds"`
+}
+
+// restCachePrewarm starts a job caching either the keys listed under a prefix in S3, or the
+// bucket/key pairs of a manifest in the request body
+func restCachePrewarm(c *gin.Context) {
+	concurrency, err := strconv.Atoi(c.DefaultQuery("concurrency", strconv.Itoa(prewarmConcurrency)))
+	if err != nil || concurrency < 1 || concurrency > maxPrewarmConcurrency {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("'concurrency' must be between 1 and %d", maxPrewarmConcurrency)})
+		return
+	}
+	bucket := strings.TrimSpace(c.Query("bucket"))
+	prefix := strings.TrimSpace(c.Query("prefix"))
+	if prefix == "" {
+		restCachePrewarmManifest(c, bucket, concurrency)
+		return
+	}
+	if bucket == "" {
+		c.JSON(400, gin.H{"error": "'bucket' not found in querystring parameters"})
+		return
+	}
+
+	log.Debugf("Pre-warming cache with prefix '%s#%s'", bucket, prefix)
+	listed, err := s3ListKeys(bucket, prefix, "")
+	if err != nil {
+		msg := fmt.Sprintf("Failed to list keys with prefix '%s' in S3 bucket '%s': %v", prefix, bucket, err)
+		log.Errorf(msg)
+		c.JSON(500, gin.H{"error": msg})
+		return
+	}
+	if len(listed) == 0 {
+		c.JSON(404, gin.H{"error": fmt.Sprintf("No keys found with prefix '%s' in S3 bucket '%s'", prefix, bucket)})
+		return
+	}
+	keys := make([]prewarmKey, len(listed))
+	for i, key := range listed {
+		keys[i] = prewarmKey{Bucket: bucket, Key: key}
+	}
+
+	job := startPrewarmJob(c, bucket, prefix, keys, concurrency)
+	c.JSON(200, gin.H{
+		"message": fmt.Sprintf("Pre-warming cache in the background with prefix '%s' from S3 bucket '%s'", prefix, bucket),
+		"id":      job.id,
+		"total":   len(keys),
+		"error":   "",
+	})
+}
+
+// restCachePrewarmManifest starts a job caching the keys of a manifest, with 'bucket' used for
+// the entries that don't name one
+func restCachePrewarmManifest(c *gin.Context, bucket string, concurrency int) {
+	keys, err := readPrewarmManifest(http.MaxBytesReader(c.Writer, c.Request.Body, maxPrewarmManifestSize), bucket)
+	if err == errPrewarmManifestTooLarge {
+		c.JSON(413, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("Invalid keys manifest: %v", err)})
+		return
+	}
+	if len(keys) == 0 {
+		c.JSON(400, gin.H{"error": "'prefix' not found in querystring parameters and no keys manifest in body"})
+		return
+	}
+	if claims := requestClaims(c); claims != nil {
+		for _, key := range keys {
+			if msg := keyScopeError(claims, key.Bucket, key.Key); msg != "" {
+				log.Debugf("JWT token scope doesn't cover prewarm manifest entry '%s': %s", constructCacheKey(key.Bucket, key.Key), msg)
+				c.JSON(401, gin.H{"error": msg})
+				return
+			}
+		}
+	}
+
+	log.Debugf("Pre-warming cache with a manifest of %d key(s)", len(keys))
+	job := startPrewarmJob(c, "", "", keys, concurrency)
+	c.JSON(200, gin.H{
+		"message": fmt.Sprintf("Pre-warming cache in the background with %d key(s) from the manifest", len(keys)),
+		"id":      job.id,
+		"total":   len(keys),
+		"error":   "",
+	})
+}
+
+func restPrewarmStatus(c *gin.Context) {
+	job, ok := getScopedPrewarmJob(c)
+	if !ok {
+		return
+	}
+	c.JSON(200, job.snapshot())
+}
+
+// restPrewarmCancel stops fetching the remaining keys of a running job, letting the ones in
+// flight finish
+func restPrewarmCancel(c *gin.Context) {
+	job, ok := getScopedPrewarmJob(c)
+	if !ok {
+		return
+	}
+	if status := job.snapshot(); status.Status != prewarmRunning {
+		c.JSON(409, gin.H{"error": fmt.Sprintf("Prewarm job '%s' already %s", job.id, status.Status)})
+		return
+	}
+	log.Infof("Cancelling prewarm job '%s'", job.id)
+	job.cancel()
+	c.JSON(200, gin.H{"message": fmt.Sprintf("Prewarm job '%s' cancelled", job.id), "error": ""})
+}
+
+// getScopedPrewarmJob looks up the job of a status or cancel request, which with JWT auth has
+// to cover the scope of the token that started the job
+func getScopedPrewarmJob(c *gin.Context) (*prewarmJob, bool) {
+	job, ok := getPrewarmJob(c.Param("id"))
+	if !ok {
+		c.JSON(404, gin.H{"error": fmt.Sprintf("Prewarm job '%s' not found", c.Param("id"))})
+		return nil, false
+	}
+	if claims := requestClaims(c); claims != nil {
+		if msg := keyScopeError(claims, job.scopeBucket, job.scopePrefix); msg != "" {
+			log.Debugf("JWT token scope doesn't cover prewarm job '%s': %s", job.id, msg)
+			c.JSON(401, gin.H{"error": msg})
+			return nil, false
+		}
+	}
+	return job, true
+}
+
+// readPrewarmManifest parses a JSON array or newline-delimited JSON objects of bucket/key pairs,
+// dropping duplicates. body is limited to maxPrewarmManifestSize bytes by the caller
+func readPrewarmManifest(body io.Reader, defaultBucket string) ([]prewarmKey, error) {
+	keys := []prewarmKey{}
+	manifest, err := ioutil.ReadAll(body)
+	if err != nil && len(manifest) >= maxPrewarmManifestSize {
+		return nil, errPrewarmManifestTooLarge
+	}
+	if err != nil {
+		return nil, err
+	}
+	manifest = bytes.TrimSpace(manifest)
+	if len(manifest) == 0 {
+		return keys, nil
+	}
+
+	entries := []prewarmKey{}
+	decoder := json.NewDecoder(bytes.NewReader(manifest))
+	if manifest[0] == '[' {
+		if err := decoder.Decode(&entries); err != nil {
+			return nil, err
+		}
+	} else {
+		for {
+			var entry prewarmKey
+			err := decoder.Decode(&entry)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, entry)
+			if len(entries) > maxPrewarmManifestKeys {
+				break
+			}
+		}
+	}
+	if len(entries) > maxPrewarmManifestKeys {
+		return nil, fmt.Errorf("more than %d entries", maxPrewarmManifestKeys)
+	}
+
+	seen := map[prewarmKey]bool{}
+	for i, entry := range entries {
+		entry.Bucket = strings.TrimSpace(entry.Bucket)
+		if entry.Bucket == "" {
+			entry.Bucket = defaultBucket
+		}
+		if entry.Bucket == "" || entry.Key == "" {
+			return nil, fmt.Errorf("entry %d needs a 'bucket' (or the 'bucket' querystring parameter) and a 'key'", i+1)
+		}
+		if seen[entry] {
+			continue
+		}
+		seen[entry] = true
+		keys = append(keys, entry)
+	}
+	return keys, nil
+}
+
+// startPrewarmJob fetches keys into the cache in the background, 'concurrency' at a time
+func startPrewarmJob(c *gin.Context, bucket string, prefix string, keys []prewarmKey, concurrency int) *prewarmJob {
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &prewarmJob{
+		id:          newPrewarmJobID(),
+		bucket:      bucket,
+		prefix:      prefix,
+		concurrency: concurrency,
+		status:      prewarmRunning,
+		total:       len(keys),
+		failedKeys:  []string{},
+		started:     time.Now(),
+		cancel:      cancel,
+	}
+	if claims := requestClaims(c); claims != nil {
+		job.scopeBucket = strings.TrimSpace(claims.Bucket)
+		job.scopePrefix = strings.TrimSpace(claims.Prefix)
+	}
+	addPrewarmJob(job)
+
+	go func() {
+		getPool := parallel.CustomJobPool(parallel.JobPoolConfig{
+			WorkerCount:  concurrency,
+			JobQueueSize: concurrency * 10,
+		})
+		defer getPool.Close()
+
+		for _, key := range keys {
+			key := key
+			getPool.AddJob(func() {
+				if ctx.Err() != nil {
+					return
+				}
+				cacheKey := constructCacheKey(key.Bucket, key.Key)
+				log.Debugf("Pre-warming cache for '%s'", cacheKey)
+				// Cancelling only stops dequeuing keys, fetches in flight finish (or time out)
+				size, err := fetchToCache(context.Background(), key.Bucket, key.Key)
+				job.record(cacheKey, size, err)
+			})
+		}
+		getPool.Wait()
+		job.finish(ctx.Err() != nil)
+		cancel()
+	}()
+	return job
+}
+
+func (j *prewarmJob) record(cacheKey string, size int64, err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if err != nil {
+		j.failed++
+		if len(j.failedKeys) < maxPrewarmFailedKeys {
+			j.failedKeys = append(j.failedKeys, cacheKey)
+		}
+		return
+	}
+	j.completed++
+	j.bytes += size
+}
+
+func (j *prewarmJob) finish(cancelled bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.status = prewarmCompleted
+	if cancelled {
+		j.status = prewarmCancelled
+	}
+	j.finished = time.Now()
+	log.Infof("Prewarm job '%s' %s: %d/%d key(s) cached, %d failed, %d bytes in %s",
+		j.id, j.status, j.completed, j.total, j.failed, j.bytes, j.finished.Sub(j.started))
+}
+
+func (j *prewarmJob) snapshot() prewarmJobStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	end := j.finished
+	if end.IsZero() {
+		end = time.Now()
+	}
+	return prewarmJobStatus{
+		ID:          j.id,
+		Bucket:      j.bucket,
+		Prefix:      j.prefix,
+		Concurrency: j.concurrency,
+		Status:      j.status,
+		Total:       j.total,
+		Completed:   j.completed,
+		Failed:      j.failed,
+		FailedKeys:  append([]string{}, j.failedKeys...),
+		Bytes:       j.bytes,
+		Started:     j.started,
+		Duration:    end.Sub(j.started).Seconds(),
+	}
+}
+
+// addPrewarmJob registers a job, dropping the oldest finished ones past maxFinishedPrewarmJobs
+func addPrewarmJob(job *prewarmJob) {
+	prewarmJobsMu.Lock()
+	defer prewarmJobsMu.Unlock()
+	prewarmJobs[job.id] = job
+
+	finished := []*prewarmJob{}
+	for _, j := range prewarmJobs {
+		j.mu.Lock()
+		running := j.status == prewarmRunning
+		j.mu.Unlock()
+		if !running {
+			finished = append(finished, j)
+		}
+	}
+	for len(finished) > maxFinishedPrewarmJobs {
+		oldest := 0
+		for i, j := range finished {
+			if j.started.Before(finished[oldest].started) {
+				oldest = i
+			}
+		}
+		delete(prewarmJobs, finished[oldest].id)
+		finished = append(finished[:oldest], finished[oldest+1:]...)
+	}
+}
+
+func getPrewarmJob(id string) (*prewarmJob, bool) {
+	prewarmJobsMu.Lock()
+	defer prewarmJobsMu.Unlock()
+	job, ok := prewarmJobs[id]
+	return job, ok
+}
+
+func newPrewarmJobID() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(id)
+}
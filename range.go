@@ -0,0 +1,153 @@
+// SPDX-FileCopyrightText: 2022 Marshall Wace <opensource@mwam.com>
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mailgun/groupcache/v2"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	errInvalidRange       = errors.New("invalid range")
+	errUnsatisfiableRange = errors.New("range not satisfiable")
+	errMultipleRanges     = errors.New("multiple ranges are not supported")
+)
+
+type byteRange struct {
+	start  int64
+	length int64
+}
+
+func (r byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, size)
+}
+
+// parseRangeHeader parses a single "bytes=" range (RFC 7233) against an object of the given size.
+// Syntactically invalid headers return errInvalidRange and should be ignored by the caller.
+func parseRangeHeader(header string, size int64) (byteRange, error) {
+	const prefix = "bytes="
+	if !strings.HasPrefix(header, prefix) {
+		return byteRange{}, errInvalidRange
+	}
+	spec := strings.TrimSpace(header[len(prefix):])
+	if strings.Contains(spec, ",") {
+		return byteRange{}, errMultipleRanges
+	}
+
+	dash := strings.Index(spec, "-")
+	if dash < 0 {
+		return byteRange{}, errInvalidRange
+	}
+	startStr := strings.TrimSpace(spec[:dash])
+	endStr := strings.TrimSpace(spec[dash+1:])
+
+	if startStr == "" {
+		// Suffix range, e.g. bytes=-500 for the last 500 bytes
+		suffix, err := strconv.ParseInt(endStr, 10, 64)
+		if err != nil || suffix < 0 {
+			return byteRange{}, errInvalidRange
+		}
+		if suffix == 0 || size == 0 {
+			return byteRange{}, errUnsatisfiableRange
+		}
+		if suffix > size {
+			suffix = size
+		}
+		return byteRange{start: size - suffix, length: suffix}, nil
+	}
+
+	start, err := strconv.ParseInt(startStr, 10, 64)
+	if err != nil || start < 0 {
+		return byteRange{}, errInvalidRange
+	}
+	end := size - 1
+	if endStr != "" {
+		end, err = strconv.ParseInt(endStr, 10, 64)
+		if err != nil || end < start {
+			return byteRange{}, errInvalidRange
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+	if start >= size {
+		return byteRange{}, errUnsatisfiableRange
+	}
+
+	return byteRange{start: start, length: end - start + 1}, nil
+}
+
+// requestedRange returns the range to serve for the request, or nil if the full object should be sent
+func requestedRange(c *gin.Context, meta objectMetadata, size int64) (*byteRange, error) {
+	header := strings.TrimSpace(c.GetHeader("Range"))
+	if header == "" {
+		return nil, nil
+	}
+	if ifRange := strings.TrimSpace(c.GetHeader("If-Range")); ifRange != "" && !ifRangeMatches(ifRange, meta) {
+		return nil, nil
+	}
+
+	r, err := parseRangeHeader(header, size)
+	if err == errInvalidRange {
+		log.Debugf("Ignoring invalid Range header '%s'", header)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// ifRangeMatches checks an If-Range validator (strong ETag or HTTP date) against the cached object
+func ifRangeMatches(ifRange string, meta objectMetadata) bool {
+	if strings.HasPrefix(ifRange, "\"") {
+		return meta.ETag != "" && ifRange == meta.ETag
+	}
+	if meta.LastModified.IsZero() {
+		return false
+	}
+	date, err := http.ParseTime(ifRange)
+	if err != nil {
+		return false
+	}
+	return meta.LastModified.UTC().Truncate(time.Second).Equal(date.UTC())
+}
+
+// serveCacheEntry writes the cached blob and its metadata headers to the response,
+// honouring any Range header by slicing the view without copying bytes
+func serveCacheEntry(c *gin.Context, meta objectMetadata, body groupcache.ByteView,
+	defaultHeaders map[string]string, renderError errorRenderer) {
+	size := int64(body.Len())
+	setMetadataHeaders(c, meta)
+	setDefaultHeaders(c, defaultHeaders)
+	c.Header("Accept-Ranges", "bytes")
+
+	if status := checkPreconditions(c, meta); status != 0 {
+		servePreconditionResult(c, status, renderError)
+		return
+	}
+
+	r, err := requestedRange(c, meta, size)
+	if err != nil {
+		c.Header("Content-Range", fmt.Sprintf("bytes */%d", size))
+		renderError(c, 416, "InvalidRange", fmt.Sprintf("Requested range not satisfiable: %v", err))
+		return
+	}
+	if r == nil {
+		c.DataFromReader(200, size, meta.contentType(), body.Reader(), nil)
+		return
+	}
+
+	c.Header("Content-Range", r.contentRange(size))
+	slice := body.Slice(int(r.start), int(r.start+r.length))
+	c.DataFromReader(206, r.length, meta.contentType(), slice.Reader(), nil)
+}
@@ -0,0 +1,249 @@
+// SPDX-FileCopyrightText: 2022 Marshall Wace <opensource@mwam.com>
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mailgun/groupcache/v2"
+	"github.com/mailgun/groupcache/v2/singleflight"
+	log "github.com/sirupsen/logrus"
+)
+
+const replicaExpireHeader = "X-Cache-Expire"
+
+var (
+	replicationFactor   int
+	maxReplicaCacheSize int64
+
+	replicas     *replicaCache
+	replicaGroup = &singleflight.Group{}
+)
+
+type ownerOnlyKey struct{}
+
+// withOwnerOnly makes cacheFiller refuse to load keys this node doesn't own, so an unreachable
+// owner is reported as errPeerUnavailable and the next replica can be tried instead of S3
+func withOwnerOnly(ctx context.Context) context.Context {
+	return context.WithValue(ctx, ownerOnlyKey{}, true)
+}
+
+func ownerOnly(ctx context.Context) bool {
+	only, _ := ctx.Value(ownerOnlyKey{}).(bool)
+	return only
+}
+
+// replicaCache holds the entries of keys this node is a replica (but not the owner) of, as
+// groupcache only keeps entries it owns in its main cache. Least recently used are evicted
+type replicaCache struct {
+	mu      sync.Mutex
+	ll      *list.List
+	entries map[string]*list.Element
+	size    int64
+	maxSize int64
+}
+
+type replicaEntry struct {
+	cacheKey string
+	value    []byte
+	expire   time.Time
+}
+
+func initReplicas() {
+	replicas = &replicaCache{
+		ll:      list.New(),
+		entries: make(map[string]*list.Element),
+		maxSize: maxReplicaCacheSize << 20,
+	}
+}
+
+func (r *replicaCache) get(cacheKey string) ([]byte, time.Time, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	el, ok := r.entries[cacheKey]
+	if !ok {
+		return nil, time.Time{}, false
+	}
+	entry := el.Value.(*replicaEntry)
+	if !entry.expire.IsZero() && time.Now().After(entry.expire) {
+		r.removeElement(el)
+		return nil, time.Time{}, false
+	}
+	r.ll.MoveToFront(el)
+	return entry.value, entry.expire, true
+}
+
+func (r *replicaCache) add(cacheKey string, value []byte, expire time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if el, ok := r.entries[cacheKey]; ok {
+		r.removeElement(el)
+	}
+	if int64(len(value)) > r.maxSize {
+		return
+	}
+	r.entries[cacheKey] = r.ll.PushFront(&replicaEntry{cacheKey: cacheKey, value: value, expire: expire})
+	r.size += int64(len(value))
+	for r.size > r.maxSize {
+		r.removeElement(r.ll.Back())
+	}
+}
+
+func (r *replicaCache) remove(cacheKey string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if el, ok := r.entries[cacheKey]; ok {
+		r.removeElement(el)
+	}
+}
+
+func (r *replicaCache) reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ll.Init()
+	r.entries = make(map[string]*list.Element)
+	r.size = 0
+}
+
+func (r *replicaCache) bytes() int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.size
+}
+
+func (r *replicaCache) removeElement(el *list.Element) {
+	entry := r.ll.Remove(el).(*replicaEntry)
+	delete(r.entries, entry.cacheKey)
+	r.size -= int64(len(entry.value))
+}
+
+// replicatedGet gets a cache entry from one of the key's owners. The owner and replicas serve
+// it themselves, other nodes spread reads across all of them starting from a random one, moving
+// on to the next while they're unreachable
+func replicatedGet(ctx context.Context, cacheKey string) (groupcache.ByteView, error) {
+	owners := keyOwners(cacheKey)
+	if len(owners) <= 1 || owners[0] == selfPeer {
+		return groupGet(ctx, cacheKey)
+	}
+	if containsString(owners[1:], selfPeer) {
+		return replicaGet(ctx, cacheKey)
+	}
+
+	start := rand.Intn(len(owners))
+	for i := range owners {
+		owner := owners[(start+i)%len(owners)]
+		var view groupcache.ByteView
+		var err error
+		if owner == owners[0] {
+			view, err = groupGet(withOwnerOnly(ctx), cacheKey)
+		} else {
+			view, err = getFromReplica(ctx, owner, cacheKey)
+		}
+		if err != errPeerUnavailable {
+			return view, err
+		}
+		log.Debugf("Owner '%s' of '%s' unreachable, trying the next one", owner, cacheKey)
+		replicaReadsMetric.WithLabelValues("failover").Inc()
+	}
+	// No owner reachable, load it here
+	return groupGet(ctx, cacheKey)
+}
+
+// replicaGet serves a key this node is a replica of, filling it from the owner, or from S3 if
+// the owner is unreachable
+func replicaGet(ctx context.Context, cacheKey string) (groupcache.ByteView, error) {
+	var view groupcache.ByteView
+	if value, expire, ok := replicas.get(cacheKey); ok {
+		replicaReadsMetric.WithLabelValues("hit").Inc()
+		err := groupcache.ByteViewSink(&view).SetBytes(value, expire)
+		return view, err
+	}
+
+	v, err := replicaGroup.Do(cacheKey, func() (interface{}, error) {
+		view, err := groupGet(withOwnerOnly(ctx), cacheKey)
+		if err == errPeerUnavailable {
+			log.Debugf("Owner of '%s' unreachable, filling replica from S3", cacheKey)
+			replicaReadsMetric.WithLabelValues("failover").Inc()
+			err = cacheFiller(withPeerErrorSlot(ctx), cacheKey, groupcache.ByteViewSink(&view))
+		}
+		if err != nil {
+			return view, err
+		}
+		replicaReadsMetric.WithLabelValues("fill").Inc()
+		replicas.add(cacheKey, view.ByteSlice(), view.Expire())
+		return view, nil
+	})
+	if err != nil {
+		return view, err
+	}
+	return v.(groupcache.ByteView), nil
+}
+
+// groupGet gets a cache entry through groupcache, from the key's owner
+func groupGet(ctx context.Context, cacheKey string) (groupcache.ByteView, error) {
+	var view groupcache.ByteView
+	err := cacheGroup.Get(ctx, cacheKey, groupcache.ByteViewSink(&view))
+	return view, err
+}
+
+// getFromReplica asks a replica for a key, which it fills if it doesn't have it yet
+func getFromReplica(ctx context.Context, replica string, cacheKey string) (groupcache.ByteView, error) {
+	var view groupcache.ByteView
+	u := fmt.Sprintf("%s/_groupcache/replica/%s", replica, url.PathEscape(cacheKey))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return view, err
+	}
+	// Through peerTransport for its typed errors
+	res, err := newPeerTransport(ctx).RoundTrip(req)
+	if err != nil {
+		return view, err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return view, errPeerUnavailable
+	}
+	if res.StatusCode != http.StatusOK {
+		return view, &cacheError{res.StatusCode, "InternalError", strings.TrimSpace(string(body))}
+	}
+
+	var expire time.Time
+	if nanos, err := strconv.ParseInt(res.Header.Get(replicaExpireHeader), 10, 64); err == nil && nanos > 0 {
+		expire = time.Unix(0, nanos)
+	}
+	err = groupcache.ByteViewSink(&view).SetBytes(body, expire)
+	return view, err
+}
+
+// serveReplica answers another node's read of a key this node is a replica of
+func serveReplica(c *gin.Context) {
+	cacheKey := strings.TrimPrefix(c.Param("blob"), "/")
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*time.Duration(timeout))
+	defer cancel()
+
+	view, err := replicaGet(withPeerErrorSlot(ctx), cacheKey)
+	if err != nil {
+		cerr := classifyError(err)
+		c.String(cerr.Status, cerr.Error())
+		return
+	}
+	if !view.Expire().IsZero() {
+		c.Header(replicaExpireHeader, strconv.FormatInt(view.Expire().UnixNano(), 10))
+	}
+	c.Data(200, "application/octet-stream", view.ByteSlice())
+}
@@ -14,12 +14,12 @@ import (
 	"github.com/adrianchifor/go-parallel"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/gin-gonic/gin"
-	"github.com/mailgun/groupcache/v2"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -60,6 +60,28 @@ func transparentS3Head(c *gin.Context) {
 	bucket := c.Param("bucket")
 	key := c.Param("key")
 
+	meta, err := cacheGetMetadata(bucket, key)
+	if err == nil {
+		log.Debugf("Serving HEAD for '%s' from cached metadata", constructCacheKey(bucket, key))
+		setMetadataHeaders(c, meta)
+		c.Header("Accept-Ranges", "bytes")
+		if status := checkPreconditions(c, meta); status != 0 {
+			// HEAD responses have no body, so only the status is sent
+			c.Status(status)
+			return
+		}
+		c.Header("Content-Length", strconv.FormatInt(meta.ContentLength, 10))
+		c.Header("Content-Type", meta.contentType())
+		c.String(200, "")
+		return
+	}
+	if cerr := classifyError(err); cerr.Status == 404 || cerr.Status == 403 {
+		log.Debugf("Serving HEAD for '%s' from cached error: %v", constructCacheKey(bucket, key), err)
+		c.String(cerr.Status, "")
+		return
+	}
+	log.Debugf("Metadata for '%s' not in cache, falling back to S3: %v", constructCacheKey(bucket, key), err)
+
 	res, err := s3Client.HeadObject(&s3.HeadObjectInput{
 		Bucket: aws.String(bucket),
 		Key:    aws.String(key),
@@ -220,7 +242,7 @@ func restS3Upload(c *gin.Context) {
 
 				if cacheOnWrite {
 					log.Debugf("Cache-on-write enabled, fetching '%s'", constructCacheKey(bucket, fullKey))
-					fetchToCache(bucket, fullKey)
+					fetchToCache(context.Background(), bucket, fullKey)
 				}
 			}()
 		})
@@ -270,7 +292,7 @@ func transparentS3Put(c *gin.Context) {
 
 		if cacheOnWrite {
 			log.Debugf("Cache-on-write enabled, fetching '%s'", constructCacheKey(bucket, key))
-			fetchToCache(bucket, key)
+			fetchToCache(context.Background(), bucket, key)
 		}
 	}()
 
@@ -282,17 +304,84 @@ func transparentS3Get(c *gin.Context) {
 	key := c.Param("key")
 
 	cacheKey := constructCacheKey(bucket, key)
+	switch meta, mode := cacheModeFor(bucket, key); mode {
+	case cacheBypass:
+		s3Stream(c, bucket, key, nil, s3Error)
+		return
+	case cacheBlocks:
+		serveCacheBlocks(c, bucket, key, meta, nil, s3Error)
+		return
+	}
+
 	log.Debugf("Checking cache for '%s'", cacheKey)
 	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*time.Duration(timeout))
 	defer cancel()
 
-	var cacheView groupcache.ByteView
-	if err := cacheGroup.Get(ctx, cacheKey, groupcache.ByteViewSink(&cacheView)); err != nil {
-		c.String(404, "")
+	meta, body, stale, err := cacheGetServable(ctx, cacheKey)
+	if err != nil {
+		renderCacheError(c, cacheKey, err, s3Error)
 		return
 	}
+	if stale {
+		c.Header("X-Cache", "STALE")
+	}
 
-	c.DataFromReader(200, int64(cacheView.Len()), "application/octet-stream", cacheView.Reader(), nil)
+	serveCacheEntry(c, meta, body, nil, s3Error)
+}
+
+// s3Stream passes the object straight through from S3 to the client without caching it,
+// letting S3 evaluate any range and conditional request headers
+func s3Stream(c *gin.Context, bucket string, key string, defaultHeaders map[string]string, renderError errorRenderer) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}
+	// If-Range can't be passed on to S3, so ranges are only forwarded without it
+	if rangeHeader := strings.TrimSpace(c.GetHeader("Range")); rangeHeader != "" && c.GetHeader("If-Range") == "" {
+		if strings.Contains(rangeHeader, ",") {
+			renderError(c, 416, "InvalidRange", fmt.Sprintf("Requested range not satisfiable: %v", errMultipleRanges))
+			return
+		}
+		input.Range = aws.String(rangeHeader)
+	}
+	if ifMatch := c.GetHeader("If-Match"); ifMatch != "" {
+		input.IfMatch = aws.String(ifMatch)
+	}
+	if ifNoneMatch := c.GetHeader("If-None-Match"); ifNoneMatch != "" {
+		input.IfNoneMatch = aws.String(ifNoneMatch)
+	}
+	if since, ok := parseConditionalDate(c.GetHeader("If-Modified-Since")); ok {
+		input.IfModifiedSince = aws.Time(since)
+	}
+	if since, ok := parseConditionalDate(c.GetHeader("If-Unmodified-Since")); ok {
+		input.IfUnmodifiedSince = aws.Time(since)
+	}
+
+	res, err := s3Client.GetObjectWithContext(c.Request.Context(), input)
+	if err != nil {
+		if reqErr, ok := err.(awserr.RequestFailure); ok {
+			if reqErr.StatusCode() == 304 {
+				c.Status(304)
+				return
+			}
+			renderError(c, reqErr.StatusCode(), reqErr.Code(), reqErr.Message())
+			return
+		}
+		renderCacheError(c, constructCacheKey(bucket, key), err, renderError)
+		return
+	}
+	defer res.Body.Close()
+
+	status := 200
+	meta := metadataFromGetObject(res)
+	setMetadataHeaders(c, meta)
+	setDefaultHeaders(c, defaultHeaders)
+	c.Header("Accept-Ranges", "bytes")
+	if res.ContentRange != nil {
+		status = 206
+		c.Header("Content-Range", *res.ContentRange)
+	}
+	c.DataFromReader(status, aws.Int64Value(res.ContentLength), meta.contentType(), res.Body, nil)
 }
 
 func restS3Delete(c *gin.Context) {
@@ -490,10 +579,40 @@ func s3ListObjects(bucket string, prefix string, delimiter string) ([]*s3.Object
 	return s3objects, s3CommonPrefixes, nil
 }
 
-func s3Download(bucket string, key string, buf *aws.WriteAtBuffer) error {
-	_, err := s3Downloader.Download(buf, &s3.GetObjectInput{
+// s3Download downloads the object (or only byteRange if set) into buf, returning the object metadata
+func s3Download(bucket string, key string, byteRange string, ifNoneMatch string, buf *aws.WriteAtBuffer) (objectMetadata, error) {
+	meta := objectMetadata{}
+	metaOnce := sync.Once{}
+
+	// Capture the object headers from the first GetObject part response
+	captureMetadata := func(r *request.Request) {
+		r.Handlers.Complete.PushBack(func(r *request.Request) {
+			if res, ok := r.Data.(*s3.GetObjectOutput); ok && r.Error == nil {
+				metaOnce.Do(func() {
+					meta = metadataFromGetObject(res)
+				})
+			}
+		})
+	}
+
+	input := &s3.GetObjectInput{
 		Bucket: aws.String(bucket),
 		Key:    aws.String(key),
-	})
-	return err
+	}
+	if byteRange != "" {
+		input.Range = aws.String(byteRange)
+	}
+	if ifNoneMatch != "" {
+		input.IfNoneMatch = aws.String(ifNoneMatch)
+	}
+
+	_, err := s3Downloader.Download(buf, input, s3manager.WithDownloaderRequestOptions(captureMetadata))
+	if err != nil {
+		return meta, err
+	}
+
+	if byteRange == "" {
+		meta.ContentLength = int64(len(buf.Bytes()))
+	}
+	return meta, nil
 }
@@ -0,0 +1,204 @@
+// SPDX-FileCopyrightText: 2022 Marshall Wace <opensource@mwam.com>
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mailgun/groupcache/v2"
+	"github.com/mailgun/groupcache/v2/singleflight"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	staleWhileRevalidate int
+	staleIfError         int
+	revalidateWindow     int
+
+	errNotModified = errors.New("object not modified in S3")
+
+	// Refreshed entries waiting to be picked up by cacheFiller, as groupcache has no way to
+	// overwrite a cached value other than removing it and filling it again
+	pendingFills sync.Map
+	refreshGroup singleflight.Group
+	// Refreshes requested from owners, apart from refreshGroup as an owner may get them back
+	// from a peer with another view of the ring
+	peerRefreshGroup singleflight.Group
+	peerClient       = &http.Client{}
+)
+
+type pendingFill struct {
+	entry  []byte
+	meta   objectMetadata
+	expire time.Time
+}
+
+// staleWindow is how long entries are kept in cache after their TTL expires
+func staleWindow() time.Duration {
+	window := time.Second * time.Duration(staleWhileRevalidate)
+	if sie := time.Second * time.Duration(staleIfError); sie > window {
+		window = sie
+	}
+	if rv := time.Minute * time.Duration(revalidateWindow); rv > window {
+		window = rv
+	}
+	return window
+}
+
+// cacheGetServable gets a cache entry like cacheGet, but handles stale entries: within the
+// stale-while-revalidate window they're returned while refreshing in the background, past it
+// they're refreshed (or revalidated by ETag) first and only returned if S3 fails within the
+// stale-if-error window. stale reports a stale entry was returned
+func cacheGetServable(ctx context.Context, cacheKey string) (objectMetadata, groupcache.ByteView, bool, error) {
+	meta, body, err := cacheGet(ctx, cacheKey)
+	if err != nil || meta.FreshUntil.IsZero() || time.Now().Before(meta.FreshUntil) {
+		return meta, body, false, err
+	}
+
+	if time.Since(meta.FreshUntil) <= time.Second*time.Duration(staleWhileRevalidate) {
+		log.Debugf("Serving stale '%s' while refreshing it", cacheKey)
+		cacheStaleMetric.WithLabelValues("revalidate").Inc()
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*time.Duration(timeout))
+			defer cancel()
+			if err := refreshCacheEntry(ctx, cacheKey, meta.ETag); err != nil {
+				log.Errorf("Failed to refresh stale '%s': %v", cacheKey, err)
+			}
+		}()
+		return meta, body, true, nil
+	}
+
+	if err := refreshCacheEntry(ctx, cacheKey, meta.ETag); err != nil {
+		withinGrace := time.Since(meta.FreshUntil) <= time.Second*time.Duration(staleIfError)
+		if withinGrace && classifyError(err).Status >= 500 {
+			log.Warnf("Serving stale '%s' as refreshing it failed: %v", cacheKey, err)
+			cacheStaleMetric.WithLabelValues("error").Inc()
+			return meta, body, true, nil
+		}
+		return meta, body, false, err
+	}
+	meta, body, err = cacheGet(ctx, cacheKey)
+	return meta, body, false, err
+}
+
+// refreshCacheEntry reloads a key from S3 on the node owning it, replacing the cached entry
+// across the cluster. If the cached entry's ETag is still current, only its expiry is extended.
+// Concurrent refreshes of a key owned by a peer are sent to it once
+func refreshCacheEntry(ctx context.Context, cacheKey string, etag string) error {
+	if peer, ok := cachePool.PickPeer(cacheKey); ok {
+		_, err := peerRefreshGroup.Do(cacheKey, func() (interface{}, error) {
+			return nil, refreshOnPeer(ctx, peer.GetURL(), cacheKey, etag)
+		})
+		return err
+	}
+	return refreshLocally(cacheKey, etag)
+}
+
+func refreshOnPeer(ctx context.Context, peerURL string, cacheKey string, etag string) error {
+	u := fmt.Sprintf("%v%v/%v", peerURL, url.QueryEscape(cacheGroup.Name()), url.QueryEscape(cacheKey))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, nil)
+	if err != nil {
+		return err
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	res, err := peerClient.Do(req)
+	if err != nil {
+		log.Debugf("Failed to ask peer '%s' to refresh '%s': %v", peerURL, cacheKey, err)
+		return errPeerUnavailable
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	body, _ := ioutil.ReadAll(res.Body)
+	if cerr, ok := parseCacheError(strings.TrimSpace(string(body))); ok {
+		return cerr
+	}
+	return &cacheError{res.StatusCode, "InternalError", strings.TrimSpace(string(body))}
+}
+
+// refreshLocally reloads a key this node owns, deduplicating concurrent refreshes
+func refreshLocally(cacheKey string, etag string) error {
+	_, err := refreshGroup.Do(cacheKey, func() (interface{}, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*time.Duration(timeout))
+		defer cancel()
+
+		result := "success"
+		entry, meta, expire, err := loadCacheEntry(cacheKey, etag)
+		if err == errNotModified {
+			result = "not_modified"
+			entry, meta, expire, err = extendCacheEntry(ctx, cacheKey, etag)
+		}
+		if err == errNotModified {
+			// Our copy is gone or has another ETag, so it can't be extended
+			result = "success"
+			entry, meta, expire, err = loadCacheEntry(cacheKey, "")
+		}
+		if err != nil {
+			cacheRefreshMetric.WithLabelValues("failure").Inc()
+			if err == errNotFound {
+				// Deleted from S3, drop it so the next get reports it missing
+				cacheGroup.Remove(ctx, cacheKey)
+			}
+			return nil, err
+		}
+
+		pendingFills.Store(cacheKey, &pendingFill{entry, meta, expire})
+		defer pendingFills.Delete(cacheKey)
+		if err := cacheGroup.Remove(ctx, cacheKey); err != nil {
+			log.Debugf("Failed to remove '%s' from some peers while refreshing: %v", cacheKey, err)
+		}
+		var view groupcache.ByteView
+		if err := cacheGroup.Get(ctx, cacheKey, groupcache.ByteViewSink(&view)); err != nil {
+			cacheRefreshMetric.WithLabelValues("failure").Inc()
+			return nil, err
+		}
+
+		log.Debugf("Refreshed '%s' in cache", cacheKey)
+		cacheRefreshMetric.WithLabelValues(result).Inc()
+		return nil, nil
+	})
+	return err
+}
+
+// extendCacheEntry re-encodes the cached copy of an object unchanged in S3 with a new expiry
+func extendCacheEntry(ctx context.Context, cacheKey string, etag string) ([]byte, objectMetadata, time.Time, error) {
+	meta, body, err := cacheGet(ctx, cacheKey)
+	if err != nil || meta.ETag != etag {
+		return nil, meta, time.Time{}, errNotModified
+	}
+
+	bucket, key, _, isBlock := parseCacheKey(cacheKey)
+	var expire time.Time
+	meta.FreshUntil, expire = entryExpiry(ttlFor(bucket, key), isBlock)
+	entry, err := encodeCacheEntry(meta, body.ByteSlice())
+	if err != nil {
+		return nil, meta, expire, err
+	}
+	log.Debugf("'%s' unchanged in S3, extending its expiry", cacheKey)
+	return entry, meta, expire, nil
+}
+
+// serveRefresh handles refreshes of keys this node owns, requested by peers serving them stale
+func serveRefresh(c *gin.Context) {
+	cacheKey := strings.TrimPrefix(c.Param("blob"), "/")
+	if err := refreshLocally(cacheKey, c.GetHeader("If-None-Match")); err != nil {
+		cerr := classifyError(err)
+		c.String(cerr.Status, cerr.Error())
+		return
+	}
+	c.Status(http.StatusOK)
+}
@@ -0,0 +1,35 @@
+#!/usr/bin/env bats
+
+load helpers.sh
+
+PEERS() { curl -s "$1/metrics" | grep '^cachenator_peers ' | awk '{print $2}'; }
+
+@test "discovering peers from kubernetes endpoints" {
+  [[ "$(PEERS $CACHE_K8S_METRICS)" == "1" ]]
+
+  # Second pod becomes ready
+  set_k8s_endpoints 8084 8085
+  sleep 2
+  [[ "$(PEERS $CACHE_K8S_METRICS)" == "2" ]]
+  [[ "$(PEERS $CACHE_K8S2_METRICS)" == "2" ]]
+
+  run GET "$CACHE_K8S/cache/owner?bucket=$BUCKET&key=blob"
+  [[ "$status" -eq 0 ]]
+  owner="$(jq -r .owner $TMP_BLOB)"
+  run GET "$CACHE_K8S2/cache/owner?bucket=$BUCKET&key=blob"
+  [[ "$(jq -r .owner $TMP_BLOB)" == "$owner" ]]
+
+  # Second pod terminates
+  set_k8s_endpoints 8084
+  sleep 2
+  [[ "$(PEERS $CACHE_K8S_METRICS)" == "1" ]]
+}
+
+@test "discovering peers from DNS" {
+  # This node as 'localhost', and as each address localhost resolves to
+  [[ "$(PEERS $CACHE_DNS_METRICS)" -ge 2 ]]
+
+  run GET "$CACHE_DNS/cache/owner?bucket=$BUCKET&key=blob"
+  [[ "$status" -eq 0 ]]
+  [[ "$output" == "200" ]]
+}
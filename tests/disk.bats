@@ -0,0 +1,37 @@
+#!/usr/bin/env bats
+
+load helpers.sh
+
+@test "serving blobs from disk after a restart" {
+  run AWS s3 cp $DIR/blob s3://$BUCKET/disk/blob
+  [[ "$status" -eq 0 ]]
+
+  run GET "$CACHE_DISK/get?bucket=$BUCKET&key=disk/blob"
+  [[ "$status" -eq 0 ]]
+  [[ "$output" == "200" ]]
+  [[ "$(ls $DISK_CACHE_DIR | wc -l)" == "1" ]]
+
+  # Memory is lost on restart and the blob is gone from S3, so it can only come from disk
+  pkill -f "cachenator -port 8098"
+  sleep 1
+  run AWS s3 rm s3://$BUCKET/disk/blob
+  [[ "$status" -eq 0 ]]
+  run_cachenator_disk
+  sleep 1
+
+  run GET "$CACHE_DISK/get?bucket=$BUCKET&key=disk/blob"
+  [[ "$status" -eq 0 ]]
+  [[ "$output" == "200" ]]
+  [[ "$(SHA $DIR/blob)" == "$(SHA $TMP_BLOB)" ]]
+}
+
+@test "invalidating blobs from disk" {
+  run POST "$CACHE_DISK/invalidate?bucket=$BUCKET&key=disk/blob"
+  [[ "$status" -eq 0 ]]
+  [[ "$output" == "200" ]]
+  [[ "$(ls $DISK_CACHE_DIR | wc -l)" == "0" ]]
+
+  run GET "$CACHE_DISK/get?bucket=$BUCKET&key=disk/blob"
+  [[ "$status" -eq 0 ]]
+  [[ "$output" == "404" ]]
+}
@@ -0,0 +1,43 @@
+#!/usr/bin/env bats
+
+load helpers.sh
+
+NODES=("http://localhost:8096" "http://localhost:8097")
+
+CIRCUIT_OPEN() {
+  port=${1##*:}
+  curl -s "http://localhost:$((port + 1013))/metrics" | grep "^cachenator_peer_circuit_open{peer=\"$2\"}" | awk '{print $2}'
+}
+
+@test "loading keys of a down owner from S3 and retrying it later" {
+  run GET "${NODES[0]}/cache/owner?bucket=$BUCKET&key=blob"
+  owner=$(jq -r .owner $TMP_BLOB)
+  for node in "${NODES[@]}"; do
+    if [[ "$node" != "$owner" ]]; then
+      other=$node
+    fi
+  done
+
+  pkill -f "cachenator -port ${owner##*:}"
+  sleep 1
+  for i in 1 2 3; do
+    run GET "$other/get?bucket=$BUCKET&key=blob"
+    [[ "$status" -eq 0 ]]
+    [[ "$output" == "200" ]]
+    [[ "$(SHA $TMP_BLOB)" == "$(SHA $DIR/blob)" ]]
+  done
+  [[ "$(CIRCUIT_OPEN $other $owner)" == "1" ]]
+
+  # Removed from the other nodes, but reported as failed while the owner can't be reached
+  run POST "$other/invalidate?bucket=$BUCKET&key=blob"
+  [[ "$output" == "500" ]]
+
+  # Restarted owner is probed after the backoff, here by the invalidation removing the key from it
+  $DIR/../bin/cachenator -port ${owner##*:} -metrics-port $((${owner##*:} + 1013)) \
+    -peers http://localhost:8096,http://localhost:8097 -peer-failure-threshold 1 -peer-retry-backoff 1 \
+    -s3-endpoint $AWS_ENDPOINT -s3-force-path-style >/dev/null 2>&1 &
+  sleep 3
+  run POST "$other/invalidate?bucket=$BUCKET&key=blob"
+  [[ "$output" == "200" ]]
+  [[ "$(CIRCUIT_OPEN $other $owner)" == "0" ]]
+}
@@ -0,0 +1,92 @@
+#!/usr/bin/env python3
+# SPDX-FileCopyrightText: 2022 Marshall Wace <opensource@mwam.com>
+# SPDX-License-Identifier: GPL-3.0-only
+
+# Fake Kubernetes API serving a single Endpoints object from a JSON file, also as EndpointSlices
+# (one per subset, as each has its own port). Watches stream events whenever the file changes.
+# Usage: fake_k8s.py <port> <endpoints.json> <bearer token>
+
+import json
+import os
+import sys
+import time
+from http.server import BaseHTTPRequestHandler, ThreadingHTTPServer
+from urllib.parse import parse_qs, urlparse
+
+PORT, ENDPOINTS_FILE, TOKEN = int(sys.argv[1]), sys.argv[2], sys.argv[3]
+ENDPOINTS_PATH = "/api/v1/namespaces/test/endpoints"
+SLICES_PATH = "/apis/discovery.k8s.io/v1/namespaces/test/endpointslices"
+
+
+def load_endpoints():
+    with open(ENDPOINTS_FILE) as f:
+        endpoints = json.load(f)
+    endpoints.setdefault("metadata", {})["resourceVersion"] = str(int(os.path.getmtime(ENDPOINTS_FILE) * 1000))
+    return endpoints
+
+
+def load_endpoint_slices():
+    endpoints = load_endpoints()
+    slices = {}
+    for i, subset in enumerate(endpoints.get("subsets", [])):
+        name = "cachenator-%d" % i
+        slices[name] = {
+            "metadata": {"name": name, "resourceVersion": endpoints["metadata"]["resourceVersion"]},
+            "addressType": "IPv4",
+            "endpoints": [{"addresses": [a["ip"]], "conditions": {"ready": True}} for a in subset["addresses"]],
+            "ports": subset["ports"],
+        }
+    return slices, endpoints["metadata"]["resourceVersion"]
+
+
+class Handler(BaseHTTPRequestHandler):
+    def do_GET(self):
+        if self.headers.get("Authorization") != "Bearer " + TOKEN:
+            self.send_response(401)
+            self.end_headers()
+            return
+
+        url = urlparse(self.path)
+        query = parse_qs(url.query)
+        slices = url.path == SLICES_PATH
+        if not slices and not url.path.startswith(ENDPOINTS_PATH):
+            self.send_response(404)
+            self.end_headers()
+            return
+
+        self.send_response(200)
+        self.send_header("Content-Type", "application/json")
+        self.end_headers()
+        if query.get("watch") != ["true"]:
+            if slices:
+                items, version = load_endpoint_slices()
+                content = {"metadata": {"resourceVersion": version}, "items": list(items.values())}
+            else:
+                content = load_endpoints()
+            self.wfile.write(json.dumps(content).encode())
+            return
+
+        mtime = os.path.getmtime(ENDPOINTS_FILE)
+        previous, _ = load_endpoint_slices()
+        deadline = time.time() + int(query.get("timeoutSeconds", ["300"])[0])
+        while time.time() < deadline:
+            time.sleep(0.2)
+            if os.path.getmtime(ENDPOINTS_FILE) == mtime:
+                continue
+            mtime = os.path.getmtime(ENDPOINTS_FILE)
+            if slices:
+                current, _ = load_endpoint_slices()
+                events = [{"type": "MODIFIED", "object": s} for s in current.values()]
+                events += [{"type": "DELETED", "object": s} for name, s in previous.items() if name not in current]
+                previous = current
+            else:
+                events = [{"type": "MODIFIED", "object": load_endpoints()}]
+            for event in events:
+                self.wfile.write((json.dumps(event) + "\n").encode())
+            self.wfile.flush()
+
+    def log_message(self, format, *args):
+        pass
+
+
+ThreadingHTTPServer(("127.0.0.1", PORT), Handler).serve_forever()
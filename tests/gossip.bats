@@ -0,0 +1,26 @@
+#!/usr/bin/env bats
+
+load helpers.sh
+
+PEERS() { curl -s "$1/metrics" | grep '^cachenator_peers ' | awk '{print $2}'; }
+
+@test "joining a cluster through a gossip seed" {
+  nodes=("$CACHE_GOSSIP_METRICS" "$CACHE_GOSSIP2_METRICS" "$CACHE_GOSSIP3_METRICS")
+  for node in "${nodes[@]}"; do
+    [[ "$(PEERS $node)" == "3" ]]
+  done
+}
+
+@test "dropping dead gossip members after the suspicion timeout" {
+  pkill -f "cachenator -port 8088"
+  sleep 5
+  [[ "$(PEERS $CACHE_GOSSIP_METRICS)" == "2" ]]
+  [[ "$(PEERS $CACHE_GOSSIP2_METRICS)" == "2" ]]
+
+  # Rejoins when restarted
+  $DIR/../bin/cachenator -port 8088 -metrics-port 9103 -gossip-seeds $CACHE_GOSSIP \
+    -gossip-suspicion-timeout 3 >/dev/null 2>&1 &
+  sleep 3
+  [[ "$(PEERS $CACHE_GOSSIP_METRICS)" == "3" ]]
+  [[ "$(PEERS $CACHE_GOSSIP3_METRICS)" == "3" ]]
+}
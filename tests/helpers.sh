@@ -13,15 +13,53 @@ CACHE_METRICS="http://localhost:9095"
 CACHE2_METRICS="http://localhost:9096"
 CACHE3_METRICS="http://localhost:9097"
 CACHE_READONLY_METRICS="http://localhost:9098"
+CACHE_K8S="http://127.0.0.1:8084"
+CACHE_K8S2="http://127.0.0.1:8085"
+CACHE_K8S_METRICS="http://localhost:9099"
+CACHE_K8S2_METRICS="http://localhost:9100"
+CACHE_GOSSIP="http://localhost:8086"
+CACHE_GOSSIP_METRICS="http://localhost:9101"
+CACHE_GOSSIP2_METRICS="http://localhost:9102"
+CACHE_GOSSIP3_METRICS="http://localhost:9103"
+CACHE_DNS="http://localhost:8089"
+CACHE_DNS_METRICS="http://localhost:9113"
+K8S_ENDPOINTS="/tmp/cachenator_endpoints.json"
 AWS_ENDPOINT="http://localhost:4566"
+ADMIN_TOKEN="admintoken"
+PEER_SECRET="peersecret"
+CACHE_REPLICATED="http://localhost:8093"
+CACHE_DISK="http://localhost:8098"
+CACHE_POLICY="http://localhost:8099"
+CACHE_POLICY_METRICS="http://localhost:9112"
+CACHE_STALE="http://localhost:8100"
+CACHE_STALE_METRICS="http://localhost:9114"
+LARGE_BLOB="/tmp/cachenator_large_blob"
+DISK_CACHE_DIR="/tmp/cachenator_disk"
+STALE_DISK_CACHE_DIR="/tmp/cachenator_stale_disk"
+TTL_RULES="/tmp/cachenator_ttl_rules.json"
+CACHE_TLS="https://localhost:8091"
+CACHE_TLS2="https://localhost:8092"
+TLS_DIR="/tmp/cachenator_tls"
 
 POST() { curl -X POST -s -o /dev/null -w '%{http_code}' "$@"; }
 GET() { curl -s -o $TMP_BLOB -w '%{http_code}' "$@"; }
-DELETE() { curl -X DELETE -s -o /dev/null -w '%{http_code}' "$1"; }
+DELETE() { curl -X DELETE -s -o /dev/null -w '%{http_code}' "$@"; }
 AWS() { aws --endpoint=$AWS_ENDPOINT "$@"; }
 AWS_TRANSPARENT() { aws --endpoint=$CACHE "$@"; }
 
 SHA() { echo $(sha256sum "$1" | awk '{print $1}'); }
+METRIC() { curl -s "$1/metrics" | grep "^$2" | awk '{print $2}'; }
+# Counter value, 0 before it's first incremented
+COUNTER() { echo $(( $(METRIC "$1" "$2") + 0 )); }
+# Retries a command every second until it succeeds, giving up after $1 seconds
+EVENTUALLY() {
+  deadline=$((SECONDS + $1))
+  shift
+  until "$@"; do
+    (( SECONDS < deadline )) || return 1
+    sleep 1
+  done
+}
 
 try_command() {
   command -v "$1" >/dev/null 2>&1
@@ -46,6 +84,14 @@ try_command jq || {
   echo "jq not found, install: https://stedolan.github.io/jq/download/"
   exit 1
 }
+try_command python3 || {
+  echo "python3 not found, install: https://www.python.org/downloads/"
+  exit 1
+}
+try_command openssl || {
+  echo "openssl not found, install: https://www.openssl.org/source/"
+  exit 1
+}
 try_command aws || {
   echo "aws not found, install: pip3 install --user awscli"
   exit 1
@@ -53,30 +99,141 @@ try_command aws || {
 
 run_cachenator() {
   export AWS_REGION="eu-west-2"
-  $DIR/../bin/cachenator -port 8080 -metrics-port 9095 -peers $CACHE,$CACHE2,$CACHE3,$CACHE_READONLY_METRICS \
-    -s3-endpoint $AWS_ENDPOINT -s3-force-path-style -s3-transparent-api >/dev/null 2>&1 &
-  $DIR/../bin/cachenator -port 8081 -metrics-port 9096 -peers $CACHE,$CACHE2,$CACHE3,$CACHE_READONLY_METRICS \
-    -s3-endpoint $AWS_ENDPOINT -s3-force-path-style -cache-on-write >/dev/null 2>&1 &
-  $DIR/../bin/cachenator -port 8082 -metrics-port 9097 -peers $CACHE,$CACHE2,$CACHE3,$CACHE_READONLY_METRICS \
-    -s3-endpoint $AWS_ENDPOINT -s3-force-path-style >/dev/null 2>&1 & \
-  $DIR/../bin/cachenator -port 8083 -metrics-port 9098 -peers $CACHE,$CACHE2,$CACHE3,$CACHE_READONLY_METRICS \
-    -s3-endpoint $AWS_ENDPOINT -s3-force-path-style -read-only >/dev/null 2>&1 &
+  $DIR/../bin/cachenator -port 8080 -metrics-port 9095 -peers $CACHE,$CACHE2,$CACHE3,$CACHE_READONLY \
+    -s3-endpoint $AWS_ENDPOINT -s3-force-path-style -negative-ttl 60 -s3-transparent-api \
+    -admin-token $ADMIN_TOKEN >/dev/null 2>&1 &
+  $DIR/../bin/cachenator -port 8081 -metrics-port 9096 -peers $CACHE,$CACHE2,$CACHE3,$CACHE_READONLY \
+    -s3-endpoint $AWS_ENDPOINT -s3-force-path-style -negative-ttl 60 -cache-on-write \
+    -admin-token $ADMIN_TOKEN >/dev/null 2>&1 &
+  $DIR/../bin/cachenator -port 8082 -metrics-port 9097 -peers $CACHE,$CACHE2,$CACHE3,$CACHE_READONLY \
+    -s3-endpoint $AWS_ENDPOINT -s3-force-path-style -negative-ttl 60 \
+    -admin-token $ADMIN_TOKEN >/dev/null 2>&1 & \
+  $DIR/../bin/cachenator -port 8083 -metrics-port 9098 -peers $CACHE,$CACHE2,$CACHE3,$CACHE_READONLY \
+    -s3-endpoint $AWS_ENDPOINT -s3-force-path-style -negative-ttl 60 -read-only \
+    -admin-token $ADMIN_TOKEN >/dev/null 2>&1 &
+}
+
+run_cachenator_replicated() {
+  for port in 8093 8094 8095; do
+    $DIR/../bin/cachenator -port $port -metrics-port $((port + 1013)) \
+      -peers http://localhost:8093,http://localhost:8094,http://localhost:8095 -replication-factor 2 \
+      -s3-endpoint $AWS_ENDPOINT -s3-force-path-style >/dev/null 2>&1 &
+  done
+}
+
+# Peers giving up on each other after a single failure, retried after a second
+run_cachenator_failover() {
+  for port in 8096 8097; do
+    $DIR/../bin/cachenator -port $port -metrics-port $((port + 1013)) \
+      -peers http://localhost:8096,http://localhost:8097 -peer-failure-threshold 1 -peer-retry-backoff 1 \
+      -s3-endpoint $AWS_ENDPOINT -s3-force-path-style >/dev/null 2>&1 &
+  done
+}
+
+# Single node applying caching policies to objects above a few megabytes and by TTL rules
+run_cachenator_policy() {
+  echo '[{"prefix": "ttl/expiring/", "ttl": 1}, {"prefix": "ttl/nocache/", "cache": false}]' > $TTL_RULES
+  $DIR/../bin/cachenator -port 8099 -metrics-port 9112 -max-cacheable-object-size 2 -cache-block-size 1 \
+    -ttl-rules-path $TTL_RULES -stale-while-revalidate 5 -stale-if-error 600 \
+    -revalidate-window 10 -s3-transparent-api \
+    -s3-endpoint $AWS_ENDPOINT -s3-force-path-style >/dev/null 2>&1 &
+}
+
+# Single node with the policy node's TTL rules and a disk cache kept across restarts, started
+# against the S3 endpoint given (default the test one)
+run_cachenator_stale() {
+  $DIR/../bin/cachenator -port 8100 -metrics-port 9114 -disk-cache-dir $STALE_DISK_CACHE_DIR \
+    -ttl-rules-path $TTL_RULES -stale-while-revalidate 5 -stale-if-error 600 \
+    -s3-endpoint ${1:-$AWS_ENDPOINT} -s3-force-path-style >/dev/null 2>&1 &
+}
+
+run_cachenator_disk() {
+  $DIR/../bin/cachenator -port 8098 -metrics-port 9111 -disk-cache-dir $DISK_CACHE_DIR \
+    -s3-endpoint $AWS_ENDPOINT -s3-force-path-style >/dev/null 2>&1 &
+}
+
+# Endpoints of the fake Kubernetes service, one subset per node as they're on different ports
+set_k8s_endpoints() {
+  subsets=""
+  for port in "$@"; do
+    subsets="$subsets{\"addresses\": [{\"ip\": \"127.0.0.1\"}], \"ports\": [{\"name\": \"http\", \"port\": $port}]},"
+  done
+  echo "{\"subsets\": [${subsets%,}]}" > $K8S_ENDPOINTS
+}
+
+run_cachenator_k8s() {
+  set_k8s_endpoints 8084
+  $DIR/fake_k8s.py 8090 $K8S_ENDPOINTS fake-token >/dev/null 2>&1 &
+  sleep 1
+  $DIR/../bin/cachenator -host 127.0.0.1 -port 8084 -metrics-port 9099 -kubeconfig $DIR/kubeconfig.yaml \
+    -peers-k8s-service cachenator >/dev/null 2>&1 &
+  $DIR/../bin/cachenator -host 127.0.0.1 -port 8085 -metrics-port 9100 -kubeconfig $DIR/kubeconfig.yaml \
+    -peers-k8s-service test/cachenator >/dev/null 2>&1 &
+}
+
+# Node discovering itself by IP, as localhost resolves to loopback addresses from /etc/hosts
+run_cachenator_dns() {
+  $DIR/../bin/cachenator -host localhost -port 8089 -metrics-port 9113 \
+    -peers-dns localhost -peers-dns-interval 1 >/dev/null 2>&1 &
+}
+
+run_cachenator_gossip() {
+  for i in 0 1 2; do
+    $DIR/../bin/cachenator -port $((8086 + i)) -metrics-port $((9101 + i)) -gossip-seeds $CACHE_GOSSIP \
+      -gossip-suspicion-timeout 3 >/dev/null 2>&1 &
+  done
+}
+
+# Test CA with a certificate for both server and client use, shared by all nodes
+generate_tls_certs() {
+  mkdir -p $TLS_DIR
+  openssl req -x509 -newkey rsa:2048 -nodes -keyout $TLS_DIR/ca.key -out $TLS_DIR/ca.crt -days 1 \
+    -subj "/CN=cachenator-test-ca" >/dev/null 2>&1
+  openssl req -newkey rsa:2048 -nodes -keyout $TLS_DIR/node.key -out $TLS_DIR/node.csr \
+    -subj "/CN=localhost" >/dev/null 2>&1
+  printf "subjectAltName=DNS:localhost,IP:127.0.0.1\nextendedKeyUsage=serverAuth,clientAuth\n" > $TLS_DIR/ext.cnf
+  openssl x509 -req -in $TLS_DIR/node.csr -CA $TLS_DIR/ca.crt -CAkey $TLS_DIR/ca.key -CAcreateserial \
+    -out $TLS_DIR/node.crt -days 1 -extfile $TLS_DIR/ext.cnf >/dev/null 2>&1
+  # Client certificate from the same CA but not named as a peer
+  openssl req -newkey rsa:2048 -nodes -keyout $TLS_DIR/client.key -out $TLS_DIR/client.csr \
+    -subj "/CN=client" >/dev/null 2>&1
+  openssl x509 -req -in $TLS_DIR/client.csr -CA $TLS_DIR/ca.crt -CAkey $TLS_DIR/ca.key -CAcreateserial \
+    -out $TLS_DIR/client.crt -days 1 >/dev/null 2>&1
+}
+
+run_cachenator_tls() {
+  generate_tls_certs
+  for port in 8091 8092; do
+    $DIR/../bin/cachenator -port $port -metrics-port $((port + 1013)) -peers $CACHE_TLS,$CACHE_TLS2 \
+      -tls-cert $TLS_DIR/node.crt -tls-key $TLS_DIR/node.key -tls-client-ca $TLS_DIR/ca.crt \
+      -peer-tls-names localhost >/dev/null 2>&1 &
+  done
 }
 
 run_cachenator_jwt() {
-  $DIR/../bin/cachenator -port 8080 -jwt-rsa-publickey-path $DIR/pubkey.crt \
-    -jwt-issuer "auth-provider" -jwt-audience "cachenator" >/dev/null 2>&1 &
+  for port in 8080 8081; do
+    $DIR/../bin/cachenator -port $port -metrics-port $((port + 1015)) -peers $CACHE,$CACHE2 \
+      -jwt-rsa-publickey-path $DIR/pubkey.crt -jwt-issuer "auth-provider" -jwt-audience "cachenator" \
+      -peer-secret $PEER_SECRET -s3-endpoint $AWS_ENDPOINT -s3-force-path-style >/dev/null 2>&1 &
+  done
+}
+
+# Signs a peer request like peerSigningTransport, from its method, host, URI, timestamp and body
+PEER_SIGNATURE() {
+  body_sum=$(printf "%s" "$5" | sha256sum | awk '{print $1}')
+  printf "%s\n%s\n%s\n%s\n%s" "$1" "$2" "$3" "$4" "$body_sum" | openssl dgst -sha256 -hmac "$PEER_SECRET" | awk '{print $NF}'
 }
 
 cleanup() {
   echo "Cleaning up cachenator processes"
   pgrep cachenator | xargs kill || echo "Couldn't find cachenator"
+  pkill -f fake_k8s.py || echo "Couldn't find fake Kubernetes API"
 
   echo "Cleaning up AWS S3 localstack"
   docker rm -f localstack-s3 >/dev/null 2>&1 || echo "Couldn't find localstack"
 
   echo "Cleaning up /tmp"
-  rm -f $TMP_BLOB || echo "Couldn't find $TMP_BLOB"
+  rm -rf $TMP_BLOB $LARGE_BLOB $K8S_ENDPOINTS $TLS_DIR $DISK_CACHE_DIR $STALE_DISK_CACHE_DIR $TTL_RULES || echo "Couldn't find $TMP_BLOB"
 
   echo "Done"
 }
\ No newline at end of file
@@ -23,10 +23,31 @@ load helpers.sh
   [[ "$(SHA $DIR/blob)" == "$(SHA $TMP_BLOB)" ]]
 }
 
+@test "getting blob byte ranges from memory" {
+  run GET "$CACHE/get?bucket=$BUCKET&key=blob" -H "Range: bytes=0-99"
+  [[ "$status" -eq 0 ]]
+  [[ "$output" == "206" ]]
+  [[ "$(head -c 100 $DIR/blob | sha256sum | awk '{print $1}')" == "$(SHA $TMP_BLOB)" ]]
+
+  run GET "$CACHE2/get?bucket=$BUCKET&key=blob" -H "Range: bytes=-100"
+  [[ "$status" -eq 0 ]]
+  [[ "$output" == "206" ]]
+  [[ "$(tail -c 100 $DIR/blob | sha256sum | awk '{print $1}')" == "$(SHA $TMP_BLOB)" ]]
+
+  run GET "$CACHE/get?bucket=$BUCKET&key=blob" -H "Range: bytes=0-1,5-10"
+  [[ "$status" -eq 0 ]]
+  [[ "$output" == "416" ]]
+
+  run GET "$CACHE/get?bucket=$BUCKET&key=blob" -H "Range: bytes=999999999-"
+  [[ "$status" -eq 0 ]]
+  [[ "$output" == "416" ]]
+}
+
 @test "getting prewarmed blob from memory" {
-  run GET "$CACHE/get?bucket=$BUCKET&key=somerandomblob"
+  # Not cached and S3 is down
+  run GET "$CACHE/get?bucket=$BUCKET&key=neverrequestedblob"
   [[ "$status" -eq 0 ]]
-  [[ "$output" == "404" ]]
+  [[ "$output" == "503" ]]
 
   run GET "$CACHE/get?bucket=$BUCKET&key=folder/blob"
   [[ "$status" -eq 0 ]]
@@ -37,7 +58,7 @@ load helpers.sh
 @test "checking if deleted blob was removed from memory" {
   run GET "$CACHE/get?bucket=$BUCKET&key=folder/subfolder/blob"
   [[ "$status" -eq 0 ]]
-  [[ "$output" == "404" ]]
+  [[ "$output" == "503" ]]
 
   run AWS_TRANSPARENT s3 cp s3://$BUCKET/blob_transparent $TMP_BLOB
   [[ "$status" -eq 1 ]]
@@ -68,7 +89,7 @@ load helpers.sh
 
   run GET "$CACHE/get?bucket=$BUCKET&key=blob"
   [[ "$status" -eq 0 ]]
-  [[ "$output" == "404" ]]
+  [[ "$output" == "503" ]]
 }
 
 # Metrics
@@ -0,0 +1,178 @@
+#!/usr/bin/env bats
+
+load helpers.sh
+
+@test "streaming objects above max-cacheable-object-size from S3" {
+  head -c 3145728 /dev/urandom > $LARGE_BLOB
+  run AWS s3 cp $LARGE_BLOB s3://$BUCKET/large/blob
+  [[ "$status" -eq 0 ]]
+
+  run GET "$CACHE_POLICY/get?bucket=$BUCKET&key=large/blob"
+  [[ "$status" -eq 0 ]]
+  [[ "$output" == "200" ]]
+  [[ "$(SHA $LARGE_BLOB)" == "$(SHA $TMP_BLOB)" ]]
+  [[ "$(METRIC $CACHE_POLICY_METRICS 'cachenator_cache_bypass_total{reason="too_large"}')" == "1" ]]
+
+  run GET "$CACHE_POLICY/cache/keys?bucket=$BUCKET&prefix=large/"
+  [[ "$status" -eq 0 ]]
+  [[ "$(jq -r .count $TMP_BLOB)" == "0" ]]
+
+  run AWS s3 rm s3://$BUCKET/large/blob
+  [[ "$status" -eq 0 ]]
+}
+
+@test "caching objects above cache-block-size in blocks" {
+  head -c 1572864 /dev/urandom > $LARGE_BLOB
+  run AWS s3 cp $LARGE_BLOB s3://$BUCKET/blocks/blob
+  [[ "$status" -eq 0 ]]
+  # Object key that looks like the cache key of a block
+  run AWS s3 cp $DIR/blob "s3://$BUCKET/blocks/blob#block0"
+  [[ "$status" -eq 0 ]]
+
+  run GET "$CACHE_POLICY/get?bucket=$BUCKET&key=blocks/blob%23block0"
+  [[ "$status" -eq 0 ]]
+  [[ "$output" == "200" ]]
+  [[ "$(SHA $DIR/blob)" == "$(SHA $TMP_BLOB)" ]]
+
+  run GET "$CACHE_POLICY/get?bucket=$BUCKET&key=blocks/blob"
+  [[ "$status" -eq 0 ]]
+  [[ "$output" == "200" ]]
+  [[ "$(SHA $LARGE_BLOB)" == "$(SHA $TMP_BLOB)" ]]
+
+  run GET "$CACHE_POLICY/get?bucket=$BUCKET&key=blocks/blob" -H "Range: bytes=1048000-1049999"
+  [[ "$status" -eq 0 ]]
+  [[ "$output" == "206" ]]
+  [[ "$(tail -c +1048001 $LARGE_BLOB | head -c 2000 | sha256sum | awk '{print $1}')" == "$(SHA $TMP_BLOB)" ]]
+
+  run GET "$CACHE_POLICY/cache/keys?bucket=$BUCKET&prefix=blocks/blob"
+  [[ "$status" -eq 0 ]]
+  [[ "$(jq -r .count $TMP_BLOB)" == "3" ]]
+  [[ "$(jq '[.keys[] | select(.block != null)] | length' $TMP_BLOB)" == "2" ]]
+
+  run AWS s3 rm s3://$BUCKET/blocks/blob
+  [[ "$status" -eq 0 ]]
+  run AWS s3 rm "s3://$BUCKET/blocks/blob#block0"
+  [[ "$status" -eq 0 ]]
+}
+
+@test "applying TTL rules by prefix" {
+  for key in blob expiring/blob nocache/blob; do
+    run AWS s3 cp $DIR/blob s3://$BUCKET/ttl/$key
+    [[ "$status" -eq 0 ]]
+  done
+
+  run GET "$CACHE_POLICY/get?bucket=$BUCKET&key=ttl/nocache/blob"
+  [[ "$status" -eq 0 ]]
+  [[ "$output" == "200" ]]
+  [[ "$(SHA $DIR/blob)" == "$(SHA $TMP_BLOB)" ]]
+  [[ "$(METRIC $CACHE_POLICY_METRICS 'cachenator_cache_bypass_total{reason="no_cache"}')" == "1" ]]
+
+  run GET "$CACHE_POLICY/get?bucket=$BUCKET&key=ttl/expiring/blob"
+  [[ "$status" -eq 0 ]]
+  [[ "$output" == "200" ]]
+  run GET "$CACHE_POLICY/get?bucket=$BUCKET&key=ttl/blob"
+  [[ "$status" -eq 0 ]]
+  [[ "$output" == "200" ]]
+
+  run GET "$CACHE_POLICY/cache/keys?bucket=$BUCKET&prefix=ttl/"
+  [[ "$status" -eq 0 ]]
+  [[ "$(jq -r .count $TMP_BLOB)" == "2" ]]
+  # Only the default -ttl of an hour keeps a key cached for more than a few minutes
+  soon=$(date -d '+15 minutes' +%s)
+  [[ "$(date -d "$(jq -r '.keys[] | select(.object == "ttl/expiring/blob") | .expire' $TMP_BLOB)" +%s)" -lt $soon ]]
+  [[ "$(date -d "$(jq -r '.keys[] | select(.object == "ttl/blob") | .expire' $TMP_BLOB)" +%s)" -gt $soon ]]
+
+  # Same rules through the transparent S3 API, whose keys start with '/'
+  bypassed=$(COUNTER $CACHE_POLICY_METRICS 'cachenator_cache_bypass_total{reason="no_cache"}')
+  run GET "$CACHE_POLICY/$BUCKET/ttl/nocache/blob"
+  [[ "$status" -eq 0 ]]
+  [[ "$output" == "200" ]]
+  [[ "$(COUNTER $CACHE_POLICY_METRICS 'cachenator_cache_bypass_total{reason="no_cache"}')" == "$((bypassed + 1))" ]]
+
+  run GET "$CACHE_POLICY/$BUCKET/ttl/expiring/blob"
+  [[ "$status" -eq 0 ]]
+  [[ "$output" == "200" ]]
+  run GET "$CACHE_POLICY/cache/keys?bucket=$BUCKET&prefix=/ttl/"
+  [[ "$status" -eq 0 ]]
+  [[ "$(jq -r .count $TMP_BLOB)" == "1" ]]
+  [[ "$(date -d "$(jq -r '.keys[] | select(.object == "/ttl/expiring/blob") | .expire' $TMP_BLOB)" +%s)" -lt $soon ]]
+
+  for key in blob expiring/blob nocache/blob; do
+    run AWS s3 rm s3://$BUCKET/ttl/$key
+    [[ "$status" -eq 0 ]]
+  done
+}
+
+# Whether a get was served from a stale entry
+STALE() { curl -s -o $TMP_BLOB -D - "$1" | grep -q "X-Cache: STALE"; }
+FRESH() { [[ "$(GET "$1")" == "200" ]] && ! STALE "$1"; }
+STALE_ON_ERROR() {
+  STALE "$1" && (( $(COUNTER $CACHE_STALE_METRICS 'cachenator_cache_stale_total{reason="error"}') > 0 ))
+}
+
+@test "serving expired blobs while refreshing them" {
+  run AWS s3 cp $DIR/blob s3://$BUCKET/ttl/expiring/stale
+  [[ "$status" -eq 0 ]]
+  run GET "$CACHE_POLICY/get?bucket=$BUCKET&key=ttl/expiring/stale"
+  [[ "$status" -eq 0 ]]
+  [[ "$output" == "200" ]]
+
+  # Past the 1 minute TTL, polled within -stale-while-revalidate
+  stale=$(COUNTER $CACHE_POLICY_METRICS 'cachenator_cache_stale_total{reason="revalidate"}')
+  EVENTUALLY 75 STALE "$CACHE_POLICY/get?bucket=$BUCKET&key=ttl/expiring/stale"
+  [[ "$(SHA $DIR/blob)" == "$(SHA $TMP_BLOB)" ]]
+  [[ "$(COUNTER $CACHE_POLICY_METRICS 'cachenator_cache_stale_total{reason="revalidate"}')" == "$((stale + 1))" ]]
+
+  # Refreshed in the background
+  EVENTUALLY 10 FRESH "$CACHE_POLICY/get?bucket=$BUCKET&key=ttl/expiring/stale"
+
+  run AWS s3 rm s3://$BUCKET/ttl/expiring/stale
+  [[ "$status" -eq 0 ]]
+}
+
+@test "revalidating expired blobs by ETag" {
+  run AWS s3 cp $DIR/blob s3://$BUCKET/ttl/expiring/revalidated
+  [[ "$status" -eq 0 ]]
+  run GET "$CACHE_POLICY/get?bucket=$BUCKET&key=ttl/expiring/revalidated"
+  [[ "$status" -eq 0 ]]
+  [[ "$output" == "200" ]]
+
+  # Past the 1 minute TTL and -stale-while-revalidate, so refreshed before being served
+  not_modified=$(COUNTER $CACHE_POLICY_METRICS 'cachenator_cache_refresh_total{result="not_modified"}')
+  sleep 66
+  run curl -s -o $TMP_BLOB -D - "$CACHE_POLICY/get?bucket=$BUCKET&key=ttl/expiring/revalidated"
+  [[ "$status" -eq 0 ]]
+  [[ "$output" == *"200 OK"* ]]
+  [[ "$output" != *"X-Cache: STALE"* ]]
+  [[ "$(SHA $DIR/blob)" == "$(SHA $TMP_BLOB)" ]]
+  [[ "$(COUNTER $CACHE_POLICY_METRICS 'cachenator_cache_refresh_total{result="not_modified"}')" == "$((not_modified + 1))" ]]
+
+  run AWS s3 rm s3://$BUCKET/ttl/expiring/revalidated
+  [[ "$status" -eq 0 ]]
+}
+
+@test "serving expired blobs while S3 is down" {
+  run AWS s3 cp $DIR/blob s3://$BUCKET/ttl/expiring/fallback
+  [[ "$status" -eq 0 ]]
+  rm -rf $STALE_DISK_CACHE_DIR
+  run_cachenator_stale
+  sleep 1
+  run GET "$CACHE_STALE/get?bucket=$BUCKET&key=ttl/expiring/fallback"
+  [[ "$status" -eq 0 ]]
+  [[ "$output" == "200" ]]
+
+  # Restarted from its disk cache with S3 unreachable
+  pkill -f "cachenator -port 8100"
+  sleep 1
+  run_cachenator_stale http://localhost:4599
+  sleep 1
+  run AWS s3 rm s3://$BUCKET/ttl/expiring/fallback
+  [[ "$status" -eq 0 ]]
+
+  # Past the 1 minute TTL and -stale-while-revalidate, within -stale-if-error
+  EVENTUALLY 80 STALE_ON_ERROR "$CACHE_STALE/get?bucket=$BUCKET&key=ttl/expiring/fallback"
+  [[ "$(SHA $DIR/blob)" == "$(SHA $TMP_BLOB)" ]]
+
+  pkill -f "cachenator -port 8100"
+  rm -rf $STALE_DISK_CACHE_DIR
+}
@@ -0,0 +1,48 @@
+#!/usr/bin/env bats
+
+load helpers.sh
+
+NODES=("http://localhost:8093" "http://localhost:8094" "http://localhost:8095")
+
+REPLICA_READS() {
+  port=${1##*:}
+  curl -s "http://localhost:$((port + 1013))/metrics" | grep "^cachenator_replica_reads_total{result=\"$2\"}" | awk '{print $2}'
+}
+
+@test "replicating keys to a second owner" {
+  run GET "$CACHE_REPLICATED/cache/owner?bucket=$BUCKET&key=blob"
+  [[ "$status" -eq 0 ]]
+  [[ "$output" == "200" ]]
+  [[ "$(jq -r '.replicas | length' $TMP_BLOB)" == "1" ]]
+  replica=$(jq -r '.replicas[0]' $TMP_BLOB)
+  [[ "$replica" != "$(jq -r .owner $TMP_BLOB)" ]]
+
+  run GET "$replica/get?bucket=$BUCKET&key=blob"
+  [[ "$status" -eq 0 ]]
+  [[ "$output" == "200" ]]
+  [[ "$(SHA $TMP_BLOB)" == "$(SHA $DIR/blob)" ]]
+  [[ "$(REPLICA_READS $replica fill)" == "1" ]]
+
+  run GET "$replica/get?bucket=$BUCKET&key=blob"
+  [[ "$(REPLICA_READS $replica hit)" -ge 1 ]]
+}
+
+@test "failing over to the replica when the owner is down" {
+  run GET "$CACHE_REPLICATED/cache/owner?bucket=$BUCKET&key=blob"
+  owner=$(jq -r .owner $TMP_BLOB)
+  replica=$(jq -r '.replicas[0]' $TMP_BLOB)
+  for node in "${NODES[@]}"; do
+    if [[ "$node" != "$owner" && "$node" != "$replica" ]]; then
+      other=$node
+    fi
+  done
+
+  pkill -f "cachenator -port ${owner##*:}"
+  sleep 1
+  for i in 1 2 3 4 5; do
+    run GET "$other/get?bucket=$BUCKET&key=blob"
+    [[ "$status" -eq 0 ]]
+    [[ "$output" == "200" ]]
+    [[ "$(SHA $TMP_BLOB)" == "$(SHA $DIR/blob)" ]]
+  done
+}
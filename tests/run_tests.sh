@@ -26,6 +26,47 @@ sleep 1
 echo -e "\nRunning S3 tests"
 bats $DIR/s3.bats
 
+echo -e "\nRunning cachenator with cache policies"
+run_cachenator_policy
+sleep 1
+
+echo -e "\nRunning cache policy tests"
+bats $DIR/policy.bats
+
+echo -e "\nRunning cachenator cluster replicating keys"
+run_cachenator_replicated
+sleep 1
+
+echo -e "\nRunning replication tests"
+bats $DIR/replication.bats
+
+echo -e "Stopping replicating cachenator cluster"
+for port in 8093 8094 8095; do
+  pkill -f "cachenator -port $port" || true
+done
+
+echo -e "\nRunning cachenator cluster failing over to S3"
+run_cachenator_failover
+sleep 1
+
+echo -e "\nRunning failover tests"
+bats $DIR/failover.bats
+
+echo -e "Stopping failing over cachenator cluster"
+for port in 8096 8097; do
+  pkill -f "cachenator -port $port" || true
+done
+
+echo -e "\nRunning cachenator with a disk cache"
+run_cachenator_disk
+sleep 1
+
+echo -e "\nRunning disk cache tests"
+bats $DIR/disk.bats
+
+echo -e "Stopping disk cachenator"
+pkill -f "cachenator -port 8098" || true
+
 echo -e "Stopping AWS S3 localstack"
 docker rm -f localstack-s3 >/dev/null 2>&1
 
@@ -35,6 +76,38 @@ bats $DIR/memory.bats
 echo -e "Stopping current cachenator cluster"
 pgrep cachenator | xargs kill
 
+echo -e "\nRunning cachenator cluster discovered from a fake Kubernetes API"
+run_cachenator_k8s
+run_cachenator_dns
+sleep 1
+
+echo -e "\nRunning discovery tests"
+bats $DIR/discovery.bats
+
+echo -e "Stopping discovered cachenator cluster"
+pgrep cachenator | xargs kill
+pkill -f fake_k8s.py
+
+echo -e "\nRunning cachenator cluster joined through gossip"
+run_cachenator_gossip
+sleep 3
+
+echo -e "\nRunning gossip tests"
+bats $DIR/gossip.bats
+
+echo -e "Stopping gossip cachenator cluster"
+pgrep cachenator | xargs kill
+
+echo -e "\nRunning cachenator cluster with mutual TLS"
+run_cachenator_tls
+sleep 1
+
+echo -e "\nRunning TLS tests"
+bats $DIR/tls.bats
+
+echo -e "Stopping TLS cachenator cluster"
+pgrep cachenator | xargs kill
+
 echo -e "\nRunning authenticated (JWT) cachenator instance"
 run_cachenator_jwt
 sleep 1
@@ -107,6 +107,210 @@ load helpers.sh
   [[ "$status" -eq 0 ]]
 }
 
+@test "getting blob metadata headers from cache" {
+  run AWS s3 cp $DIR/blob s3://$BUCKET/blob_with_metadata --content-type text/plain --metadata team=data
+  [[ "$status" -eq 0 ]]
+
+  run curl -s -o /dev/null -D - "$CACHE/get?bucket=$BUCKET&key=blob_with_metadata"
+  [[ "$status" -eq 0 ]]
+  [[ "$output" == *"Content-Type: text/plain"* ]]
+  [[ "$output" == *"X-Amz-Meta-Team: data"* ]]
+  [[ "$output" == *"Etag: "* ]]
+  [[ "$output" == *"Last-Modified: "* ]]
+}
+
+@test "answering HEAD requests from cached metadata" {
+  run AWS s3 cp $DIR/blob s3://$BUCKET/head/blob
+  [[ "$status" -eq 0 ]]
+
+  run GET "$CACHE/$BUCKET/head/blob"
+  [[ "$status" -eq 0 ]]
+  [[ "$output" == "200" ]]
+
+  # Gone from S3, but still answered from the cached metadata
+  run AWS s3 rm s3://$BUCKET/head/blob
+  [[ "$status" -eq 0 ]]
+
+  run curl -s -I "$CACHE/$BUCKET/head/blob"
+  [[ "$status" -eq 0 ]]
+  [[ "$output" == *"200 OK"* ]]
+  [[ "$output" == *"Content-Length: $(stat -c %s $DIR/blob)"* ]]
+}
+
+@test "getting blob conditionally from cache" {
+  etag=$(curl -s -o /dev/null -D - "$CACHE/get?bucket=$BUCKET&key=blob_with_metadata" | grep -i '^etag:' | awk '{print $2}' | tr -d '\r')
+  [[ "$etag" != "" ]]
+
+  run GET "$CACHE/get?bucket=$BUCKET&key=blob_with_metadata" -H "If-None-Match: $etag"
+  [[ "$status" -eq 0 ]]
+  [[ "$output" == "304" ]]
+
+  run GET "$CACHE/get?bucket=$BUCKET&key=blob_with_metadata" -H "If-Match: \"somethingelse\""
+  [[ "$status" -eq 0 ]]
+  [[ "$output" == "412" ]]
+
+  run GET "$CACHE/get?bucket=$BUCKET&key=blob_with_metadata" -H "If-Modified-Since: Thu, 01 Jan 1970 00:00:00 GMT"
+  [[ "$status" -eq 0 ]]
+  [[ "$output" == "200" ]]
+
+  # Keep the bucket to the blobs counted by the listing tests
+  run AWS s3 rm s3://$BUCKET/blob_with_metadata
+  [[ "$status" -eq 0 ]]
+}
+
+@test "caching missing blob lookups" {
+  run GET "$CACHE/get?bucket=$BUCKET&key=blob_created_later"
+  [[ "$status" -eq 0 ]]
+  [[ "$output" == "404" ]]
+  [[ "$(jq -r .error $TMP_BLOB)" == *"does not exist"* ]]
+
+  run AWS s3 cp $DIR/blob s3://$BUCKET/blob_created_later
+  [[ "$status" -eq 0 ]]
+
+  # Miss is served from cache until it expires or is invalidated
+  run GET "$CACHE2/get?bucket=$BUCKET&key=blob_created_later"
+  [[ "$status" -eq 0 ]]
+  [[ "$output" == "404" ]]
+
+  run POST "$CACHE/invalidate?bucket=$BUCKET&key=blob_created_later"
+  [[ "$status" -eq 0 ]]
+  [[ "$output" == "200" ]]
+
+  run GET "$CACHE2/get?bucket=$BUCKET&key=blob_created_later"
+  [[ "$status" -eq 0 ]]
+  [[ "$output" == "200" ]]
+  [[ "$(SHA $DIR/blob)" == "$(SHA $TMP_BLOB)" ]]
+
+  run AWS s3 rm s3://$BUCKET/blob_created_later
+  [[ "$status" -eq 0 ]]
+}
+
+@test "invalidating cached prefix from all nodes" {
+  run AWS s3 cp $DIR/blob s3://$BUCKET/partition/blob
+  [[ "$status" -eq 0 ]]
+
+  nodes=("$CACHE" "$CACHE2" "$CACHE3")
+  for node in "${nodes[@]}"; do
+    run GET "$node/get?bucket=$BUCKET&key=partition/blob"
+    [[ "$status" -eq 0 ]]
+    [[ "$output" == "200" ]]
+  done
+  # Cached miss of a blob uploaded under the prefix afterwards
+  run GET "$CACHE/get?bucket=$BUCKET&key=partition/created_later"
+  [[ "$status" -eq 0 ]]
+  [[ "$output" == "404" ]]
+
+  run AWS s3 cp $DIR/../README.md s3://$BUCKET/partition/blob
+  [[ "$status" -eq 0 ]]
+  run AWS s3 cp $DIR/blob s3://$BUCKET/partition/created_later
+  [[ "$status" -eq 0 ]]
+
+  run POST "$CACHE2/invalidate?bucket=$BUCKET&key=partition/blob&prefix=partition/"
+  [[ "$status" -eq 0 ]]
+  [[ "$output" == "400" ]]
+
+  run POST "$CACHE2/invalidate?bucket=$BUCKET&prefix=part*/"
+  [[ "$status" -eq 0 ]]
+  [[ "$output" == "200" ]]
+
+  for node in "${nodes[@]}"; do
+    run GET "$node/get?bucket=$BUCKET&key=partition/blob"
+    [[ "$status" -eq 0 ]]
+    [[ "$output" == "200" ]]
+    [[ "$(SHA $DIR/../README.md)" == "$(SHA $TMP_BLOB)" ]]
+  done
+  run GET "$CACHE/get?bucket=$BUCKET&key=partition/created_later"
+  [[ "$status" -eq 0 ]]
+  [[ "$output" == "200" ]]
+  [[ "$(SHA $DIR/blob)" == "$(SHA $TMP_BLOB)" ]]
+
+  run AWS s3 rm s3://$BUCKET/partition/blob
+  [[ "$status" -eq 0 ]]
+  run AWS s3 rm s3://$BUCKET/partition/created_later
+  [[ "$status" -eq 0 ]]
+}
+
+@test "listing cached keys across the cluster" {
+  run AWS s3 cp $DIR/blob s3://$BUCKET/introspect/blob
+  [[ "$status" -eq 0 ]]
+
+  run GET "$CACHE3/get?bucket=$BUCKET&key=introspect/blob"
+  [[ "$status" -eq 0 ]]
+  [[ "$output" == "200" ]]
+
+  run GET "$CACHE/cache/keys?bucket=$BUCKET&prefix=intro*/&cluster=true"
+  [[ "$status" -eq 0 ]]
+  [[ "$output" == "200" ]]
+  [[ "$(jq -r '.keys[0].key' $TMP_BLOB)" == "$BUCKET#introspect/blob" ]]
+  # Listed by the node owning it, which filled it
+  [[ "$(jq -r '.keys[0].node == .keys[0].owner' $TMP_BLOB)" == "true" ]]
+  [[ "$(jq -r '.keys[0].size > 0' $TMP_BLOB)" == "true" ]]
+
+  run GET "$CACHE/cache/keys?limit=0"
+  [[ "$status" -eq 0 ]]
+  [[ "$output" == "400" ]]
+}
+
+@test "looking up cached key owners" {
+  run GET "$CACHE/cache/owner?bucket=$BUCKET&key=introspect/blob"
+  [[ "$status" -eq 0 ]]
+  [[ "$output" == "200" ]]
+  owner="$(jq -r .owner $TMP_BLOB)"
+  [[ "$owner" =~ ^($CACHE|$CACHE2|$CACHE3|$CACHE_READONLY)$ ]]
+
+  # Every node agrees on the owner
+  run GET "$CACHE2/cache/owner?bucket=$BUCKET&key=introspect/blob"
+  [[ "$status" -eq 0 ]]
+  [[ "$(jq -r .owner $TMP_BLOB)" == "$owner" ]]
+
+  run GET "$CACHE/cache/owner?top=5"
+  [[ "$status" -eq 0 ]]
+  [[ "$output" == "200" ]]
+  [[ "$(jq -r '.keys | length > 0 and length <= 5' $TMP_BLOB)" == "true" ]]
+
+  run GET "$CACHE/cache/owner?bucket=$BUCKET"
+  [[ "$status" -eq 0 ]]
+  [[ "$output" == "400" ]]
+
+  run AWS s3 rm s3://$BUCKET/introspect/blob
+  [[ "$status" -eq 0 ]]
+}
+
+@test "managing peers through the admin API" {
+  run GET "$CACHE/admin/peers"
+  [[ "$status" -eq 0 ]]
+  [[ "$output" == "401" ]]
+
+  run GET "$CACHE/admin/peers" -H "Authorization: Bearer $ADMIN_TOKEN"
+  [[ "$status" -eq 0 ]]
+  [[ "$output" == "200" ]]
+  [[ "$(jq -r '.peers | length' $TMP_BLOB)" == "4" ]]
+
+  run curl -X PUT -s -o /dev/null -w '%{http_code}' "$CACHE/admin/peers" -H "Authorization: Bearer $ADMIN_TOKEN" \
+    -d '{"peers": ["http://peer1/path"]}'
+  [[ "$status" -eq 0 ]]
+  [[ "$output" == "400" ]]
+
+  run curl -X PUT -s -o /dev/null -w '%{http_code}' "$CACHE/admin/peers" -H "Authorization: Bearer $ADMIN_TOKEN" \
+    -d '{"peers": [" "]}'
+  [[ "$status" -eq 0 ]]
+  [[ "$output" == "400" ]]
+
+  # Without peer auth, peers propagating changes need the admin token too
+  run curl -X PUT -s -o /dev/null -w '%{http_code}' "$CACHE2/_groupcache/peers" -d '{"peers": ["http://peer1:8080"]}'
+  [[ "$status" -eq 0 ]]
+  [[ "$output" == "401" ]]
+
+  # Same peers, set on every node
+  run curl -X PUT -s -o /dev/null -w '%{http_code}' "$CACHE/admin/peers?propagate=true" \
+    -H "Authorization: Bearer $ADMIN_TOKEN" -d "{\"peers\": [\"$CACHE2\", \"$CACHE3\", \"$CACHE_READONLY\"]}"
+  [[ "$status" -eq 0 ]]
+  [[ "$output" == "200" ]]
+
+  run GET "$CACHE/admin/peers" -H "Authorization: Bearer $ADMIN_TOKEN"
+  [[ "$(jq -r '.peers | length' $TMP_BLOB)" == "4" ]]
+}
+
 # List
 
 @test "listing keys from test bucket" {
@@ -206,4 +410,67 @@ load helpers.sh
   run POST "$CACHE_READONLY/prewarm?bucket=$BUCKET&prefix=folder"
   [[ "$status" -eq 0 ]]
   [[ "$output" == "200" ]]
-}
\ No newline at end of file
+}
+
+@test "tracking and cancelling prewarm jobs" {
+  id=$(curl -s -X POST "$CACHE/prewarm?bucket=$BUCKET&prefix=folder" | jq -r .id)
+  [[ "$id" != "null" ]]
+  sleep 1
+
+  run GET "$CACHE/prewarm/$id"
+  [[ "$status" -eq 0 ]]
+  [[ "$output" == "200" ]]
+  [[ "$(jq -r .status $TMP_BLOB)" == "completed" ]]
+  [[ "$(jq -r .failed $TMP_BLOB)" == "0" ]]
+  [[ "$(jq -r .completed $TMP_BLOB)" == "$(jq -r .total $TMP_BLOB)" ]]
+  [[ "$(jq -r .bytes $TMP_BLOB)" -gt 0 ]]
+
+  # Finished jobs can't be cancelled
+  run DELETE "$CACHE/prewarm/$id"
+  [[ "$status" -eq 0 ]]
+  [[ "$output" == "409" ]]
+
+  # Jobs are tracked by the node they were started on
+  run GET "$CACHE2/prewarm/$id"
+  [[ "$status" -eq 0 ]]
+  [[ "$output" == "404" ]]
+}
+
+@test "prewarming a manifest of keys" {
+  run POST "$CACHE/prewarm" -d '[{"bucket": "test"}]'
+  [[ "$status" -eq 0 ]]
+  [[ "$output" == "400" ]]
+
+  run POST "$CACHE/prewarm?bucket=$BUCKET&concurrency=0" -d '[{"key": "blob"}]'
+  [[ "$status" -eq 0 ]]
+  [[ "$output" == "400" ]]
+
+  # Manifests over 100000 entries or 16 MB are rejected
+  seq 100001 | sed 's/.*/{"key": "&"}/' > $TMP_BLOB.manifest
+  run POST "$CACHE/prewarm?bucket=$BUCKET" --data-binary @$TMP_BLOB.manifest
+  [[ "$status" -eq 0 ]]
+  [[ "$output" == "400" ]]
+  head -c 17000000 /dev/zero > $TMP_BLOB.manifest
+  run POST "$CACHE/prewarm?bucket=$BUCKET" --data-binary @$TMP_BLOB.manifest
+  rm $TMP_BLOB.manifest
+  [[ "$status" -eq 0 ]]
+  [[ "$output" == "413" ]]
+
+  # Duplicates are dropped, entries without a bucket use the querystring one
+  manifest="{\"bucket\": \"$BUCKET\", \"key\": \"blob\"}
+{\"key\": \"blob\"}
+{\"key\": \"folder/blob\"}
+{\"bucket\": \"$BUCKET\", \"key\": \"somerandomblob\"}"
+  id=$(curl -s -X POST "$CACHE/prewarm?bucket=$BUCKET&concurrency=2" --data-binary "$manifest" | jq -r .id)
+  [[ "$id" != "null" ]]
+  sleep 1
+
+  run GET "$CACHE/prewarm/$id"
+  [[ "$status" -eq 0 ]]
+  [[ "$output" == "200" ]]
+  [[ "$(jq -r .status $TMP_BLOB)" == "completed" ]]
+  [[ "$(jq -r .concurrency $TMP_BLOB)" == "2" ]]
+  [[ "$(jq -r .total $TMP_BLOB)" == "3" ]]
+  [[ "$(jq -r .completed $TMP_BLOB)" == "2" ]]
+  [[ "$(jq -r '.failedKeys[0]' $TMP_BLOB)" == "$BUCKET#somerandomblob" ]]
+}
@@ -0,0 +1,49 @@
+#!/usr/bin/env bats
+
+load helpers.sh
+
+TLS_GET() {
+  curl -s -o $TMP_BLOB -w '%{http_code}' --cacert $TLS_DIR/ca.crt \
+    --cert $TLS_DIR/node.crt --key $TLS_DIR/node.key "$@"
+}
+
+@test "serving clients with certificates over TLS" {
+  run TLS_GET "$CACHE_TLS/healthz"
+  [[ "$status" -eq 0 ]]
+  [[ "$output" == "200" ]]
+
+  run TLS_GET "$CACHE_TLS/admin/peers"
+  [[ "$status" -eq 0 ]]
+  [[ "$output" == "403" ]]
+
+  run TLS_GET "$CACHE_TLS/cache/owner?bucket=$BUCKET&key=blob"
+  [[ "$status" -eq 0 ]]
+  [[ "$output" == "200" ]]
+  [[ "$(jq -r .owner $TMP_BLOB)" == https://* ]]
+}
+
+@test "rejecting clients without certificates" {
+  run curl -s -o /dev/null --cacert $TLS_DIR/ca.crt "$CACHE_TLS/healthz"
+  [[ "$status" -ne 0 ]]
+
+  run GET "http://localhost:8091/healthz"
+  [[ "$output" == "400" ]]
+}
+
+@test "calling peers over mutual TLS" {
+  run TLS_GET "$CACHE_TLS/cache/keys?cluster=true"
+  [[ "$status" -eq 0 ]]
+  [[ "$output" == "200" ]]
+  [[ "$(jq -r .error $TMP_BLOB)" == "" ]]
+}
+
+@test "allowing only named peer certificates on peer routes" {
+  run TLS_GET "$CACHE_TLS/_groupcache/keys"
+  [[ "$status" -eq 0 ]]
+  [[ "$output" == "200" ]]
+
+  run curl -s -o /dev/null -w '%{http_code}' --cacert $TLS_DIR/ca.crt \
+    --cert $TLS_DIR/client.crt --key $TLS_DIR/client.key "$CACHE_TLS/_groupcache/keys"
+  [[ "$status" -eq 0 ]]
+  [[ "$output" == "401" ]]
+}
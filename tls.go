@@ -0,0 +1,85 @@
+// SPDX-FileCopyrightText: 2022 Marshall Wace <opensource@mwam.com>
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	tlsCertFlag     string
+	tlsKeyFlag      string
+	tlsClientCAFlag string
+
+	// Transport for all peer-to-peer requests, presenting this node's certificate with TLS
+	peerHTTPTransport http.RoundTripper = http.DefaultTransport
+)
+
+// peerScheme is the scheme of peer URLs, https when serving TLS
+func peerScheme() string {
+	if tlsCertFlag != "" {
+		return "https"
+	}
+	return "http"
+}
+
+// initTLS configures the peer transport to trust the -tls-client-ca (on top of system CAs) and
+// to present this node's certificate, as peers may require client certificates
+func initTLS() {
+	if tlsCertFlag == "" {
+		return
+	}
+
+	cert, err := tls.LoadX509KeyPair(tlsCertFlag, tlsKeyFlag)
+	if err != nil {
+		log.Fatalf("tls-cert/tls-key invalid: %v.", err)
+	}
+	rootCAs, err := x509.SystemCertPool()
+	if err != nil {
+		rootCAs = x509.NewCertPool()
+	}
+	if tlsClientCAFlag != "" {
+		if err := appendCAFile(rootCAs, tlsClientCAFlag); err != nil {
+			log.Fatalf("tls-client-ca invalid: %v.", err)
+		}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      rootCAs,
+	}
+	peerHTTPTransport = transport
+	peerClient.Transport = transport
+}
+
+// serverTLSConfig requires client certificates signed by -tls-client-ca if set
+func serverTLSConfig() *tls.Config {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if tlsClientCAFlag != "" {
+		tlsConfig.ClientCAs = x509.NewCertPool()
+		if err := appendCAFile(tlsConfig.ClientCAs, tlsClientCAFlag); err != nil {
+			log.Fatalf("tls-client-ca invalid: %v.", err)
+		}
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig
+}
+
+func appendCAFile(pool *x509.CertPool, path string) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if !pool.AppendCertsFromPEM(content) {
+		return fmt.Errorf("no PEM certificates in %s", path)
+	}
+	return nil
+}
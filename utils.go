@@ -20,8 +20,8 @@ func cleanupPeers(peers []string) []string {
 	cleanedPeers := []string{}
 	for _, peer := range peers {
 		cleanPeer := strings.TrimSpace(peer)
-		if !strings.Contains(cleanPeer, "http://") {
-			cleanPeer = fmt.Sprintf("http://%s", cleanPeer)
+		if !strings.Contains(cleanPeer, "://") {
+			cleanPeer = fmt.Sprintf("%s://%s", peerScheme(), cleanPeer)
 		}
 		if strings.Count(cleanPeer, ":") < 2 {
 			cleanPeer = fmt.Sprintf("%s:%d", cleanPeer, port)
@@ -45,8 +45,14 @@ func serverGracefulShutdown(server *http.Server, quit <-chan os.Signal, done cha
 	close(done)
 }
 
+// '#' is escaped in bucket and object names, so it only ever separates the parts of a cache key
+var (
+	cacheKeyEscaper   = strings.NewReplacer("%", "%25", "#", "%23")
+	cacheKeyUnescaper = strings.NewReplacer("%25", "%", "%23", "#")
+)
+
 func constructCacheKey(bucket string, key string) string {
-	return fmt.Sprintf("%s#%s", bucket, key)
+	return fmt.Sprintf("%s#%s", cacheKeyEscaper.Replace(bucket), cacheKeyEscaper.Replace(key))
 }
 
 func jsonLogMiddleware() gin.HandlerFunc {
@@ -122,3 +128,23 @@ func getClientIP(c *gin.Context) string {
 func unsupportedRequest(c *gin.Context) {
 	c.String(400, "Unsupported request under read-only mode.")
 }
+
+// setDefaultHeaders sets response headers that weren't already set, e.g. from cached S3 metadata
+func setDefaultHeaders(c *gin.Context, headers map[string]string) {
+	for k, v := range headers {
+		if c.Writer.Header().Get(k) == "" {
+			c.Header(k, v)
+		}
+	}
+}
+
+// errorRenderer writes an error response in the format of the API being served
+type errorRenderer func(c *gin.Context, status int, code string, message string)
+
+func restError(c *gin.Context, status int, code string, message string) {
+	c.JSON(status, gin.H{"error": message})
+}
+
+func s3Error(c *gin.Context, status int, code string, message string) {
+	c.XML(status, Error{code, message})
+}